@@ -0,0 +1,149 @@
+// Package aferosynctest is a conformance test suite for afero.Fs backends used with aferosync. It
+// checks that syncs produce the expected trees and updates on the backend, skipping the tests that
+// need an optional interface the backend doesn't implement.
+package aferosynctest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+)
+
+// caps is a set of optional capabilities an afero.Fs can implement.
+type caps int
+
+const (
+	// capSymlinks requires afero.Symlinker and aferosync.Lchowner.
+	capSymlinks caps = 1 << iota
+	// capHardLinks requires aferosync.Linker and a root FileInfo implementing aferosync.FileInfoInoer.
+	capHardLinks
+	// capOwnership requires a root FileInfo implementing aferosync.FileInfoOwner.
+	capOwnership
+	// capXattrs requires aferosync.Xattrer.
+	capXattrs
+)
+
+func (c caps) String() string {
+	names := []string{}
+	for _, cn := range []struct {
+		cap  caps
+		name string
+	}{
+		{capSymlinks, "symlinks"},
+		{capHardLinks, "hard links"},
+		{capOwnership, "ownership"},
+		{capXattrs, "xattrs"},
+	} {
+		if c&cn.cap != 0 {
+			names = append(names, cn.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// detect returns the capabilities afs implements.
+func detect(afs afero.Fs) (c caps) {
+	_, symlinker := afs.(afero.Symlinker)
+	_, lchowner := afs.(aferosync.Lchowner)
+	if symlinker && lchowner {
+		c |= capSymlinks
+	}
+
+	var rootFileInfo any
+	if fi, err := afs.Stat("/"); err == nil {
+		rootFileInfo = fi
+	}
+
+	_, linker := afs.(aferosync.Linker)
+	_, inoer := rootFileInfo.(aferosync.FileInfoInoer)
+	if linker && inoer {
+		c |= capHardLinks
+	}
+
+	if _, ok := rootFileInfo.(aferosync.FileInfoOwner); ok {
+		c |= capOwnership
+	}
+
+	if _, ok := afs.(aferosync.Xattrer); ok {
+		c |= capXattrs
+	}
+
+	return c
+}
+
+// capOpts returns the options that disable syncing what c lacks.
+func capOpts(c caps) (opts []aferosync.Option) {
+	if c&capSymlinks == 0 {
+		opts = append(opts, aferosync.WithSymlinks(false))
+	}
+	if c&capHardLinks == 0 {
+		opts = append(opts, aferosync.WithHardLinks(false))
+	}
+	if c&capOwnership == 0 {
+		opts = append(opts, aferosync.WithOwnership(false))
+	}
+	return opts
+}
+
+// requireCaps skips the test if afs doesn't implement all of want.
+func requireCaps(t *testing.T, afs afero.Fs, want caps) {
+	t.Helper()
+
+	if missing := want &^ detect(afs); missing != 0 {
+		t.Skipf("fs doesn't support %s", missing)
+	}
+}
+
+// Run runs the conformance test suite against the filesystems returned by newFs. Each test calls
+// newFs once and removes everything from the returned filesystem before it starts, so newFs may
+// return the same filesystem every time. Tests that need symlinks, hard links, ownership or
+// extended attributes are skipped if the filesystem doesn't implement the matching aferosync
+// interfaces, and the matching options are disabled for the rest. opts are passed to every sync.
+func Run(t *testing.T, newFs func() afero.Fs, opts ...aferosync.Option) {
+	opts = append(opts, capOpts(detect(newFs()))...)
+
+	for _, test := range []func(t *testing.T, afs afero.Fs, opts ...aferosync.Option){
+		testRegularFileAdd,
+		testRegularFileDelete,
+		testRegularFileChmod,
+		testRegularFileChown,
+		testRegularFileChownSetgid,
+		testRegularFileOverwriteModTime,
+		testRegularFileOverwriteSize,
+		testRegularFileOverwriteDir,
+		testRegularFileOverwriteSymlink,
+		testRegularFileOverwriteHardLink,
+		testRegularFileAtomic,
+		testRegularFileNoop,
+		testRegularFileSparse,
+
+		testDirAdd,
+		testDirDelete,
+		testDirDeleteRollup,
+		testDirChmod,
+		testDirChown,
+		testDirOverwriteRegularFile,
+		testDirOverwriteSymlink,
+		testDirModTime,
+		testDirNoop,
+		testDirPreserveModTime,
+		testDirPreserveModTimeAlternating,
+		testDirPreserveModTimeReplaced,
+		testDirDeferred,
+		testDirPreserveModTimeSymlink,
+		testDirPreserveModTimeHardLink,
+
+		testSymlink,
+		testLink,
+		testTarOut,
+
+		testSummary,
+		testSummaryCounts,
+
+		testXattrs,
+	} {
+		test(t, newFs(), opts...)
+	}
+}
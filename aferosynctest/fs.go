@@ -0,0 +1,59 @@
+package aferosynctest
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+)
+
+// punchHoleFs records the holes punched into its files.
+type punchHoleFs struct {
+	afero.Fs
+	holes [][2]int64
+}
+
+func (p *punchHoleFs) Create(name string) (afero.File, error) {
+	f, err := p.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &punchHoleFile{File: f, fs: p}, nil
+}
+
+type punchHoleFile struct {
+	afero.File
+	fs *punchHoleFs
+}
+
+func (f *punchHoleFile) PunchHole(offset, length int64) error {
+	f.fs.holes = append(f.fs.holes, [2]int64{offset, length})
+	return nil
+}
+
+func ptr[T any](t T) *T {
+	return &t
+}
+
+// summary returns the summary of sync without its duration, which varies between runs.
+func summary(sync *aferosync.Sync) aferosync.Summary {
+	s := sync.Summary()
+	s.Duration = 0
+	return s
+}
+
+// reference: /usr/local/go/src/os/file_posix.go
+func posixMode(i os.FileMode) (o uint32) {
+	o |= uint32(i.Perm())
+	if i&os.ModeSetuid != 0 {
+		o |= syscall.S_ISUID
+	}
+	if i&os.ModeSetgid != 0 {
+		o |= syscall.S_ISGID
+	}
+	if i&os.ModeSticky != 0 {
+		o |= syscall.S_ISVTX
+	}
+	return
+}
@@ -0,0 +1,385 @@
+package aferosynctest
+
+import (
+	"archive/tar"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+)
+
+// Tree is a filesystem tree as a list of tar entries. Parents come before their children and hard
+// links come after their targets. Names are relative, dot-slash prefixed and directory names end
+// with a slash, like in the archives NewTar tests build by hand.
+type Tree []struct {
+	Header tar.Header
+	Body   string
+}
+
+// TreeConfig configures RandomTree and MutateTree.
+type TreeConfig struct {
+	// MaxEntries limits the number of entries. Defaults to 20.
+	MaxEntries int
+
+	Symlinks  bool // generate symlinks
+	HardLinks bool // generate hard links
+	Ownership bool // generate non-root owners
+}
+
+var awkwardNames = []string{
+	"with space",
+	"-dash",
+	"ünïcödé",
+	"日本語",
+	".hidden",
+	"..dots",
+	"trailing.",
+	`back\slash`,
+	"$var",
+	"*?[glob]",
+	`'quote"`,
+	"#hash",
+	strings.Repeat("long", 30),
+}
+
+var fileModes = []int64{0644, 0600, 0755, 0700, 0777, 0444, 0000, 04755, 02755, 06755, 01644}
+
+var dirModes = []int64{0755, 0700, 0777, 0555, 0500, 02775, 01777}
+
+var owners = []int{0, 1000, 1001}
+
+// RandomTree returns a random tree of regular files, directories and, if enabled, symlinks and
+// hard links with random modes, owners, modtimes and awkward names.
+func RandomTree(r *rand.Rand, cfg TreeConfig) Tree {
+	return MutateTree(r, nil, cfg)
+}
+
+// MutateTree returns a copy of tree with random entries kept, changed, replaced by a different
+// type or removed, and random entries added. Removing or replacing a directory removes its
+// descendants. The result is a valid tree again.
+func MutateTree(r *rand.Rand, tree Tree, cfg TreeConfig) Tree {
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 20
+	}
+
+	g := &generator{r: r, cfg: cfg}
+
+	ret := Tree{}
+	for _, e := range tree {
+		switch g.r.IntN(6) {
+		case 0:
+			// remove
+			continue
+		case 1:
+			// change attributes
+			e.Header.Mode = g.mode(e.Header.Typeflag)
+			e.Header.Uid, e.Header.Gid = g.owner(), g.owner()
+			e.Header.ModTime = g.modTime()
+			if e.Header.Typeflag == tar.TypeReg {
+				e.Body = g.body()
+			}
+		case 2:
+			// replace with a different type
+			e = g.entry(treePath(e.Header.Name), ret)
+		}
+		ret = append(ret, e)
+	}
+	ret = ret.fixup()
+
+	for n := g.r.IntN(maxEntries + 1); len(ret) < n; {
+		dirs := []string{""}
+		for _, e := range ret {
+			if e.Header.Typeflag == tar.TypeDir {
+				dirs = append(dirs, treePath(e.Header.Name))
+			}
+		}
+		name := path.Join(dirs[g.r.IntN(len(dirs))], g.name())
+		if ret.index(name) >= 0 {
+			continue
+		}
+		ret = append(ret, g.entry(name, ret))
+	}
+
+	return ret.fixup()
+}
+
+// Tar returns tree as a tar archive.
+func (tree Tree) Tar() ([]byte, error) {
+	return NewTar(tree)
+}
+
+// WriteFs writes tree into afs directly, without syncing. Directory modes and all modtimes are set
+// last, deepest first.
+func (tree Tree) WriteFs(afs afero.Fs) error {
+	for _, e := range tree {
+		name := treePath(e.Header.Name)
+		switch e.Header.Typeflag {
+		case tar.TypeDir:
+			if err := afs.Mkdir(name, 0700); err != nil {
+				return fmt.Errorf("failed to mkdir: %s: %w", name, err)
+			}
+		case tar.TypeReg:
+			if err := afero.WriteFile(afs, name, []byte(e.Body), 0600); err != nil {
+				return fmt.Errorf("failed to write file: %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			symlinker, ok := afs.(afero.Symlinker)
+			if !ok {
+				return fmt.Errorf("failed to symlink: %s: fs doesn't implement afero.Symlinker", name)
+			}
+			if err := symlinker.SymlinkIfPossible(e.Header.Linkname, name); err != nil {
+				return fmt.Errorf("failed to symlink: %s: %w", name, err)
+			}
+		case tar.TypeLink:
+			linker, ok := afs.(aferosync.Linker)
+			if !ok {
+				return fmt.Errorf("failed to link: %s: fs doesn't implement aferosync.Linker", name)
+			}
+			if err := linker.Link(treePath(e.Header.Linkname), name); err != nil {
+				return fmt.Errorf("failed to link: %s: %w", name, err)
+			}
+			continue
+		}
+
+		if e.Header.Uid != 0 || e.Header.Gid != 0 {
+			if err := lchown(afs, e.Header.Typeflag, name, e.Header.Uid, e.Header.Gid); err != nil {
+				return err
+			}
+		}
+
+		// chmod after chown, chown clears setuid and setgid
+		if e.Header.Typeflag == tar.TypeReg {
+			if err := afs.Chmod(name, fileMode(e.Header.Mode)); err != nil {
+				return fmt.Errorf("failed to chmod: %s: %w", name, err)
+			}
+		}
+	}
+
+	for i := len(tree) - 1; i >= 0; i-- {
+		e := tree[i]
+		name := treePath(e.Header.Name)
+		switch e.Header.Typeflag {
+		case tar.TypeLink:
+			continue
+		case tar.TypeDir:
+			if err := afs.Chmod(name, fileMode(e.Header.Mode)); err != nil {
+				return fmt.Errorf("failed to chmod: %s: %w", name, err)
+			}
+		}
+
+		if err := afs.Chtimes(name, e.Header.ModTime, e.Header.ModTime); err != nil {
+			return fmt.Errorf("failed to chtimes: %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// String returns tree one entry per line, for failure messages.
+func (tree Tree) String() string {
+	sb := strings.Builder{}
+	for _, e := range tree {
+		switch e.Header.Typeflag {
+		case tar.TypeDir:
+			fmt.Fprintf(&sb, "dir     %q", e.Header.Name)
+		case tar.TypeReg:
+			fmt.Fprintf(&sb, "file    %q body=%q", e.Header.Name, e.Body)
+		case tar.TypeSymlink:
+			fmt.Fprintf(&sb, "symlink %q -> %q", e.Header.Name, e.Header.Linkname)
+		case tar.TypeLink:
+			fmt.Fprintf(&sb, "link    %q => %q", e.Header.Name, e.Header.Linkname)
+		}
+		fmt.Fprintf(&sb, " mode=%04o owner=%d:%d mtime=%d\n",
+			e.Header.Mode, e.Header.Uid, e.Header.Gid, e.Header.ModTime.Unix())
+	}
+	return sb.String()
+}
+
+// index returns the index of the entry at name, or -1.
+func (tree Tree) index(name string) int {
+	for i, e := range tree {
+		if treePath(e.Header.Name) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// without returns a copy of tree without the entry at i and the entries that depend on it.
+func (tree Tree) without(i int) Tree {
+	ret := append(append(Tree{}, tree[:i]...), tree[i+1:]...)
+	return ret.fixup()
+}
+
+// fixup removes entries whose parent isn't a directory in tree and hard links whose target isn't
+// a regular file before them, and copies the target attributes to hard links.
+func (tree Tree) fixup() Tree {
+	ret := Tree{}
+	for _, e := range tree {
+		name := treePath(e.Header.Name)
+		if dir := path.Dir(name); dir != "." {
+			if i := ret.index(dir); i < 0 || ret[i].Header.Typeflag != tar.TypeDir {
+				continue
+			}
+		}
+
+		if e.Header.Typeflag == tar.TypeLink {
+			i := ret.index(treePath(e.Header.Linkname))
+			if i < 0 || ret[i].Header.Typeflag != tar.TypeReg {
+				continue
+			}
+			e.Header.Mode = ret[i].Header.Mode
+			e.Header.Uid, e.Header.Gid = ret[i].Header.Uid, ret[i].Header.Gid
+			e.Header.ModTime = ret[i].Header.ModTime
+		}
+
+		ret = append(ret, e)
+	}
+
+	return ret
+}
+
+type generator struct {
+	r   *rand.Rand
+	cfg TreeConfig
+}
+
+// entry returns a random entry at name. Hard links target regular files in tree.
+func (g *generator) entry(name string, tree Tree) (e struct {
+	Header tar.Header
+	Body   string
+}) {
+	types := []byte{tar.TypeReg, tar.TypeDir}
+	if g.cfg.Symlinks {
+		types = append(types, tar.TypeSymlink)
+	}
+
+	var files []string
+	for _, te := range tree {
+		if te.Header.Typeflag == tar.TypeReg && treePath(te.Header.Name) != name {
+			files = append(files, treePath(te.Header.Name))
+		}
+	}
+	if g.cfg.HardLinks && len(files) > 0 {
+		types = append(types, tar.TypeLink)
+	}
+
+	e.Header = tar.Header{
+		Typeflag: types[g.r.IntN(len(types))],
+		Name:     "./" + name,
+		Uid:      g.owner(),
+		Gid:      g.owner(),
+		ModTime:  g.modTime(),
+	}
+	e.Header.Mode = g.mode(e.Header.Typeflag)
+
+	switch e.Header.Typeflag {
+	case tar.TypeReg:
+		e.Body = g.body()
+	case tar.TypeDir:
+		e.Header.Name += "/"
+	case tar.TypeSymlink:
+		e.Header.Linkname = g.symlinkTarget(name, tree)
+	case tar.TypeLink:
+		e.Header.Linkname = "./" + files[g.r.IntN(len(files))]
+	}
+
+	return e
+}
+
+func (g *generator) name() string {
+	if g.r.IntN(3) == 0 {
+		return awkwardNames[g.r.IntN(len(awkwardNames))]
+	}
+	return string(rune('a'+g.r.IntN(6))) + string(rune('a'+g.r.IntN(6)))
+}
+
+func (g *generator) mode(typeflag byte) int64 {
+	switch typeflag {
+	case tar.TypeDir:
+		return dirModes[g.r.IntN(len(dirModes))]
+	case tar.TypeSymlink:
+		return 0777
+	default:
+		return fileModes[g.r.IntN(len(fileModes))]
+	}
+}
+
+func (g *generator) owner() int {
+	if !g.cfg.Ownership {
+		return 0
+	}
+	return owners[g.r.IntN(len(owners))]
+}
+
+func (g *generator) modTime() time.Time {
+	return time.Unix(946684800+g.r.Int64N(30*365*24*60*60), 0)
+}
+
+func (g *generator) body() string {
+	switch g.r.IntN(4) {
+	case 0:
+		return ""
+	case 1:
+		return strings.Repeat("x", g.r.IntN(2048))
+	default:
+		return fmt.Sprintf("body %d", g.r.IntN(100))
+	}
+}
+
+// symlinkTarget returns a relative, absolute or dangling target for a symlink at name.
+func (g *generator) symlinkTarget(name string, tree Tree) string {
+	if len(tree) == 0 || g.r.IntN(4) == 0 {
+		return "dangling-" + g.name()
+	}
+
+	target := treePath(tree[g.r.IntN(len(tree))].Header.Name)
+	if g.r.IntN(2) == 0 {
+		return "/" + target
+	}
+	return strings.Repeat("../", strings.Count(name, "/")) + target
+}
+
+// treePath returns the relative path of a tar entry name.
+func treePath(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// fileMode converts a tar header mode to an os.FileMode.
+func fileMode(mode int64) os.FileMode {
+	m := os.FileMode(mode).Perm()
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func lchown(afs afero.Fs, typeflag byte, name string, uid, gid int) error {
+	if typeflag == tar.TypeSymlink {
+		lchowner, ok := afs.(aferosync.Lchowner)
+		if !ok {
+			return fmt.Errorf("failed to lchown: %s: fs doesn't implement aferosync.Lchowner", name)
+		}
+		if err := lchowner.Lchown(name, uid, gid); err != nil {
+			return fmt.Errorf("failed to lchown: %s: %w", name, err)
+		}
+		return nil
+	}
+
+	if err := afs.Chown(name, uid, gid); err != nil {
+		return fmt.Errorf("failed to chown: %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package aferosynctest
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// RoundTripConfig configures RoundTrip.
+type RoundTripConfig struct {
+	// Seed seeds the random trees. Failures report it so they can be reproduced.
+	Seed uint64
+	// Iterations is the number of tree pairs to try. Defaults to 100.
+	Iterations int
+	// MaxEntries limits the number of entries in each tree. Defaults to 20.
+	MaxEntries int
+}
+
+// RoundTrip is a property test: for random trees A and B, where B is a mutation of A, it writes A
+// into an empty filesystem returned by newFs, syncs B over it and asserts that the filesystem
+// equals B. A is synced on even iterations and written with Tree.WriteFs on odd ones, and the
+// filesystem is asserted to equal A too. Symlinks, hard links and owners are only generated if the
+// filesystem supports them. On failure, the trees are shrunk to a minimal pair that still fails.
+func RoundTrip(t *testing.T, newFs func() afero.Fs, cfg RoundTripConfig, opts ...aferosync.Option) {
+	t.Helper()
+
+	iterations := cfg.Iterations
+	if iterations <= 0 {
+		iterations = 100
+	}
+
+	c := detect(newFs())
+	opts = append(opts, capOpts(c)...)
+	treeCfg := TreeConfig{
+		MaxEntries: cfg.MaxEntries,
+		Symlinks:   c&capSymlinks != 0,
+		HardLinks:  c&capHardLinks != 0,
+		Ownership:  c&capOwnership != 0,
+	}
+
+	r := rand.New(rand.NewPCG(cfg.Seed, 0))
+	for i := range iterations {
+		rt := roundTrip{newFs: newFs, opts: opts, writeFs: i%2 == 1}
+		a := RandomTree(r, treeCfg)
+		b := MutateTree(r, a, treeCfg)
+
+		err := rt.check(a, b)
+		if err == nil {
+			continue
+		}
+
+		a, b, err = rt.shrink(a, b, err)
+		t.Fatalf("round trip failed: seed %d, iteration %d, write fs %t: %s\nA:\n%sB:\n%s",
+			cfg.Seed, i, rt.writeFs, err, a, b)
+	}
+}
+
+type roundTrip struct {
+	newFs   func() afero.Fs
+	opts    []aferosync.Option
+	writeFs bool
+}
+
+// check returns an error if writing a and syncing b doesn't leave the filesystem equal to b.
+func (rt roundTrip) check(a, b Tree) error {
+	afs := rt.newFs()
+	if err := Clear(afs); err != nil {
+		return fmt.Errorf("failed to clear: %w", err)
+	}
+
+	aBts, err := a.Tar()
+	if err != nil {
+		return fmt.Errorf("failed to build A: %w", err)
+	}
+
+	if rt.writeFs {
+		if err := a.WriteFs(afs); err != nil {
+			return fmt.Errorf("failed to write A: %w", err)
+		}
+	} else {
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(aBts)), rt.opts...)
+		if _, err := sync.Run(); err != nil {
+			return fmt.Errorf("failed to sync A: %w", err)
+		}
+	}
+
+	if err := compareTars(aBts, afs); err != nil {
+		return fmt.Errorf("fs doesn't equal A: %w", err)
+	}
+
+	bBts, err := b.Tar()
+	if err != nil {
+		return fmt.Errorf("failed to build B: %w", err)
+	}
+
+	sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), rt.opts...)
+	if _, err := sync.Run(); err != nil {
+		return fmt.Errorf("failed to sync B: %w", err)
+	}
+
+	if err := compareTars(bBts, afs); err != nil {
+		return fmt.Errorf("fs doesn't equal B: %w", err)
+	}
+
+	return nil
+}
+
+// shrink removes entries from a and b one at a time for as long as check keeps failing.
+func (rt roundTrip) shrink(a, b Tree, err error) (Tree, Tree, error) {
+	for shrunk := true; shrunk; {
+		shrunk = false
+
+		for i := 0; i < len(b) && !shrunk; i++ {
+			if cerr := rt.check(a, b.without(i)); cerr != nil {
+				b, err, shrunk = b.without(i), cerr, true
+			}
+		}
+
+		for i := 0; i < len(a) && !shrunk; i++ {
+			if cerr := rt.check(a.without(i), b); cerr != nil {
+				a, err, shrunk = a.without(i), cerr, true
+			}
+		}
+	}
+
+	return a, b, err
+}
+
+// compareTars returns an error describing the differences between the expected tar archive and
+// afs.
+func compareTars(expectedTarBytes []byte, afs afero.Fs) error {
+	expectedFiles, actualFiles, err := readTars(expectedTarBytes, afs)
+	if err != nil {
+		return err
+	}
+
+	rec := &errorRecorder{}
+	if !assert.Equal(rec, expectedFiles, actualFiles) {
+		return fmt.Errorf("%s", strings.Join(rec.msgs, "\n"))
+	}
+
+	return nil
+}
+
+// errorRecorder is an assert.TestingT that records the messages of failed assertions.
+type errorRecorder struct {
+	msgs []string
+}
+
+func (r *errorRecorder) Errorf(format string, args ...any) {
+	r.msgs = append(r.msgs, fmt.Sprintf(format, args...))
+}
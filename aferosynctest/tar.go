@@ -0,0 +1,318 @@
+package aferosynctest
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// NewTar returns a tar archive of files. Header sizes are set from the bodies.
+func NewTar(files []struct {
+	Header tar.Header
+	Body   string
+}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	tarWriter := tar.NewWriter(buf)
+
+	for _, tf := range files {
+		tf.Header.Size = int64(len(tf.Body))
+		if err := tarWriter.WriteHeader(&tf.Header); err != nil {
+			return nil, fmt.Errorf("failed to write header: %s: %w", tf.Header.Name, err)
+		}
+
+		if len(tf.Body) > 0 {
+			if _, err := io.Copy(tarWriter, bytes.NewBufferString(tf.Body)); err != nil {
+				return nil, fmt.Errorf("failed to write file: %s: %w", tf.Header.Name, err)
+			}
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ReadTar reads all headers and bodies from a tar archive.
+func ReadTar(bts []byte) ([]struct {
+	Header tar.Header
+	Body   string
+}, error) {
+	ret := []struct {
+		Header tar.Header
+		Body   string
+	}{}
+
+	tarReader := tar.NewReader(bytes.NewBuffer(bts))
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read next: %w", err)
+		}
+
+		body := bytes.NewBuffer(nil)
+		_, err = io.Copy(body, tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %s: %w", hdr.Name, err)
+		}
+
+		ret = append(ret, struct {
+			Header tar.Header
+			Body   string
+		}{
+			Header: *hdr,
+			Body:   body.String(),
+		})
+	}
+
+	return ret, nil
+}
+
+// AssertEqualTars asserts that afs, as written by aferosync.TarOut, holds the same files as the
+// expected tar archive. Leading dot-slashes, the root directory, user and group names, the tar
+// format, xattrs and the choice of hard link leaders are ignored.
+func AssertEqualTars(t *testing.T, expectedTarBytes []byte, afs afero.Fs) {
+	t.Helper()
+
+	expectedFiles, actualFiles, err := readTars(expectedTarBytes, afs)
+	require.Nil(t, err)
+
+	assert.Equal(t, expectedFiles, actualFiles)
+}
+
+// readTars reads the expected tar archive and the TarOut of afs, normalized for comparison.
+func readTars(expectedTarBytes []byte, afs afero.Fs) (expectedFiles, actualFiles []struct {
+	Header tar.Header
+	Body   string
+}, err error) {
+	actualTarBuf := bytes.NewBuffer(nil)
+	if err := aferosync.TarOut(afs, ".", actualTarBuf); err != nil {
+		return nil, nil, fmt.Errorf("failed to tar out: %w", err)
+	}
+
+	actualFiles, err = ReadTar(actualTarBuf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read actual tar: %w", err)
+	}
+
+	expectedFiles, err = ReadTar(expectedTarBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read expected tar: %w", err)
+	}
+
+	normalizeTar(&expectedFiles)
+	normalizeTar(&actualFiles)
+	return expectedFiles, actualFiles, nil
+}
+
+func normalizeTar(files *[]struct {
+	Header tar.Header
+	Body   string
+}) {
+	for i := 0; i < len(*files); i++ {
+		// Remove leading dot-slahes to normalize.
+		// Not all TarOut implementations produce them.
+		(*files)[i].Header.Name = filepath.Clean((*files)[i].Header.Name)
+		(*files)[i].Header.Linkname = filepath.Clean((*files)[i].Header.Linkname)
+
+		// ignore the root folder
+		if (*files)[i].Header.Name == "." {
+			(*files) = append((*files)[:i], (*files)[i+1:]...)
+			i--
+			continue
+		}
+
+		// ignore user and group names
+		(*files)[i].Header.Uname = ""
+		(*files)[i].Header.Gname = ""
+
+		// ignore format
+		(*files)[i].Header.Format = 0
+
+		// ignore xattrs, not all TarOut implementations include them
+		(*files)[i].Header.Xattrs = nil
+		for k := range (*files)[i].Header.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				delete((*files)[i].Header.PAXRecords, k)
+			}
+		}
+		// ignore the records Name and Linkname were read from
+		delete((*files)[i].Header.PAXRecords, "path")
+		delete((*files)[i].Header.PAXRecords, "linkpath")
+		if len((*files)[i].Header.PAXRecords) == 0 {
+			(*files)[i].Header.PAXRecords = nil
+		}
+	}
+
+	// normalize hard links (link to the alphabetically first path)
+	leaders := map[string]string{}
+	leader := func(name string) string {
+		for {
+			next, ok := leaders[name]
+			if !ok {
+				return name
+			}
+			name = next
+		}
+	}
+	for _, file := range *files {
+		if file.Header.Typeflag == tar.TypeLink {
+			leaders[file.Header.Name] = file.Header.Linkname
+		}
+	}
+	first := map[string]string{}
+	for _, file := range *files {
+		if file.Header.Typeflag == tar.TypeLink {
+			l := leader(file.Header.Name)
+			if f, ok := first[l]; !ok || file.Header.Name < f {
+				first[l] = file.Header.Name
+			}
+			if f := first[l]; l < f {
+				first[l] = l
+			}
+		}
+	}
+	for i, file := range *files {
+		l := leader(file.Header.Name)
+		f, ok := first[l]
+		if !ok || f == l {
+			continue
+		}
+		switch file.Header.Name {
+		case l:
+			// the regular file takes the first name
+			(*files)[i].Header.Name = f
+		case f:
+			// the first name's link takes the regular file's name
+			(*files)[i].Header.Name = l
+			(*files)[i].Header.Linkname = f
+		default:
+			(*files)[i].Header.Linkname = f
+		}
+	}
+
+	sort.Slice(*files, func(i, j int) bool {
+		return (*files)[i].Header.Name < (*files)[j].Header.Name
+	})
+}
+
+// newSparseTar returns a tar archive of a single sparse regular file of size bytes whose only data
+// is body at offset. The sparse map is stored in an old GNU 'S' header if gnu is set, and in a
+// GNU.sparse 1.0 PAX entry otherwise. archive/tar reads both formats but writes neither.
+func newSparseTar(name string, size, offset int64, body string, modTime time.Time, gnu bool) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	if gnu {
+		blk := tarHeaderBlock(name, 'S', int64(len(body)), modTime, true)
+		tarNumeric(blk[386:398], offset)
+		tarNumeric(blk[398:410], int64(len(body)))
+		tarNumeric(blk[483:495], size)
+		tarChecksum(blk)
+		buf.Write(blk)
+	} else {
+		records := tarPAXRecord("GNU.sparse.major", "1") +
+			tarPAXRecord("GNU.sparse.minor", "0") +
+			tarPAXRecord("GNU.sparse.name", name) +
+			tarPAXRecord("GNU.sparse.realsize", strconv.FormatInt(size, 10))
+		blk := tarHeaderBlock("./PaxHeaders/"+path.Base(name), 'x', int64(len(records)), modTime, false)
+		tarChecksum(blk)
+		buf.Write(blk)
+		buf.Write(tarPad([]byte(records)))
+
+		sparseMap := tarPad([]byte(fmt.Sprintf("1\n%d\n%d\n", offset, len(body))))
+		blk = tarHeaderBlock("./GNUSparseFile.0/"+path.Base(name), '0', int64(len(sparseMap)+len(body)), modTime, false)
+		tarChecksum(blk)
+		buf.Write(blk)
+		buf.Write(sparseMap)
+	}
+
+	buf.Write(tarPad([]byte(body)))
+	buf.Write(make([]byte, 1024))
+
+	return buf.Bytes()
+}
+
+// tarHeaderBlock returns a header block of a file owned by root with mode 0644 and no checksum.
+func tarHeaderBlock(name string, typeflag byte, size int64, modTime time.Time, gnu bool) []byte {
+	blk := make([]byte, 512)
+	copy(blk[0:100], name)
+	tarNumeric(blk[100:108], 0644)
+	tarNumeric(blk[108:116], 0)
+	tarNumeric(blk[116:124], 0)
+	tarNumeric(blk[124:136], size)
+	tarNumeric(blk[136:148], modTime.Unix())
+	blk[156] = typeflag
+	if gnu {
+		copy(blk[257:265], "ustar  \x00")
+	} else {
+		copy(blk[257:265], "ustar\x0000")
+	}
+	return blk
+}
+
+func tarNumeric(field []byte, v int64) {
+	copy(field, fmt.Sprintf("%0*o\x00", len(field)-1, v))
+}
+
+func tarChecksum(blk []byte) {
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+// tarPAXRecord formats a PAX record, whose length prefix counts itself.
+func tarPAXRecord(k, v string) string {
+	rec := " " + k + "=" + v + "\n"
+	n := len(rec)
+	for n != len(strconv.Itoa(n))+len(rec) {
+		n = len(strconv.Itoa(n)) + len(rec)
+	}
+	return strconv.Itoa(n) + rec
+}
+
+// tarPad pads data with zeros to a multiple of the block size.
+func tarPad(data []byte) []byte {
+	return append(data, make([]byte, (512-len(data)%512)%512)...)
+}
+
+// Clear removes everything from afs.
+func Clear(afs afero.Fs) error {
+	root, err := afs.Open("/")
+	if err != nil {
+		return fmt.Errorf("failed to open root: %w", err)
+	}
+
+	dirnames, err := root.Readdirnames(-1)
+	if err != nil {
+		return fmt.Errorf("failed to read dir names: %w", err)
+	}
+
+	for _, dirname := range dirnames {
+		err = afs.RemoveAll(dirname)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dirname, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,3068 @@
+package aferosynctest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"math/rand/v2"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRegularFileAdd(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Add", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Added:   true,
+				Mode:    ptr(fs.ModePerm),
+				ModTime: ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Size:    ptr(int64(9)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileDelete(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Delete", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar(nil)
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Deleted:    true,
+				OldType:    0,
+				OldSize:    ptr(int64(9)),
+				FreedBytes: 9,
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileChmod(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Chmod", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Mode:    ptr(fs.ModePerm),
+				OldMode: ptr(fs.FileMode(0644)),
+			},
+		}}, updates)
+		assert.Equal(t, "updated test.txt mode=0644->0777", updates[0].String())
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileChown(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Chown", func(t *testing.T) {
+		requireCaps(t, afs, capOwnership)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				Uid:     1000,
+				Gid:     1000,
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		fi, err := afs.Stat("test.txt")
+		require.Nil(t, err)
+		owner := fi.(aferosync.FileInfoOwner)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Uid:    ptr(1000),
+				Gid:    ptr(1000),
+				OldUid: ptr(owner.Uid()),
+				OldGid: ptr(owner.Gid()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileChownSetgid(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	// Assert that setting setgid bit and changing group owner at the same time works.
+	// Chown may reset the setgid bit. It will if the file has the group execute bit
+	// set too and chown changes the group. Test for that not happening.
+	t.Run("RegularFile/Chown/Setgid", func(t *testing.T) {
+		requireCaps(t, afs, capOwnership)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(posixMode(fs.ModePerm | fs.ModeSetgid)),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				Uid:     1000,
+				Gid:     1001,
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		fi, err := afs.Stat("test.txt")
+		require.Nil(t, err)
+		owner := fi.(aferosync.FileInfoOwner)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Uid:     ptr(1000),
+				Gid:     ptr(1001),
+				Mode:    ptr(fs.ModePerm | fs.ModeSetgid),
+				OldUid:  ptr(owner.Uid()),
+				OldGid:  ptr(owner.Gid()),
+				OldMode: ptr(fs.FileMode(0644)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileOverwriteModTime(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Overwrite/ModTime", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(0777),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text1"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				ContentChanged: true,
+				Size:           ptr(int64(10)),
+				OldSize:        ptr(int64(10)),
+				ModTime:        ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				OldModTime:     ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Mode:           ptr(fs.ModePerm),
+				OldMode:        ptr(fs.FileMode(0644)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileOverwriteSize(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Overwrite/Size", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				ContentChanged: true,
+				Size:           ptr(int64(10)),
+				OldSize:        ptr(int64(9)),
+				Mode:           ptr(fs.ModePerm),
+				OldMode:        ptr(fs.FileMode(0644)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileOverwriteSymlink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Overwrite/Symlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "test.txt")
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Replaced: true,
+				OldType:  fs.ModeSymlink,
+				NewType:  0,
+				ModTime:  ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Mode:     ptr(fs.ModePerm),
+				Size:     ptr(int64(9)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileOverwriteDir(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Overwrite/Dir", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("test.txt", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Mkdir("test.txt/sub", fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test.txt/sub/child.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Replaced: true,
+				OldType:  fs.ModeDir,
+				NewType:  0,
+				ModTime:  ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Mode:     ptr(fs.ModePerm),
+				Size:     ptr(int64(9)),
+			},
+		}, {
+			Path: "test.txt/sub",
+			Update: aferosync.Update{
+				Deleted: true,
+				OldType: fs.ModeDir,
+			},
+		}, {
+			Path: "test.txt/sub/child.txt",
+			Update: aferosync.Update{
+				Deleted:    true,
+				OldSize:    ptr(int64(9)),
+				FreedBytes: 9,
+			},
+		}}, updates)
+		assert.Equal(t, aferosync.Summary{Deleted: 2, Replaced: 1, Files: 1, BytesRead: 9, BytesWritten: 9, BytesFreed: 9}, summary(sync))
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileOverwriteHardLink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Overwrite/HardLink", func(t *testing.T) {
+		requireCaps(t, afs, capHardLinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		rootFileInfo, err := afs.Stat(".")
+		require.Nil(t, err)
+		if _, ok := rootFileInfo.(aferosync.FileInfoNlinker); !ok {
+			t.Skip("fs returned a FileInfo that doesn't implement aferosync.FileInfoNlinker")
+		}
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./other.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text1",
+		}, {
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "other.txt", []byte("some text1"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chmod("other.txt", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("other.txt", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.(aferosync.Linker).Link("other.txt", "test.txt")
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileNoop(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Noop", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate(nil), updates)
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testRegularFileSparse(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Sparse", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// punchHoleFs hides the optional interfaces of afs
+		hfs := &punchHoleFs{Fs: afs}
+		opts = append(opts, aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))
+
+		// build tar
+		body := make([]byte, 12292)
+		copy(body[4096:], "some text")
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./disk.img",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: string(body),
+		}})
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(hfs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithSparse(true))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		assert.Equal(t, [][2]int64{{0, 4096}, {8192, 4100}}, hfs.holes)
+		AssertEqualTars(t, bts, afs)
+	})
+
+	for _, format := range []struct {
+		name string
+		gnu  bool
+	}{{"GNU", true}, {"PAX", false}} {
+		t.Run("RegularFile/Sparse/"+format.name, func(t *testing.T) {
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// punchHoleFs hides the optional interfaces of afs
+			hfs := &punchHoleFs{Fs: afs}
+			opts := append(opts, aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))
+
+			// build tar
+			bts := newSparseTar("./disk.img", 12292, 4096, "some text", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), format.gnu)
+
+			body := make([]byte, 12292)
+			copy(body[4096:], "some text")
+			expected, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./disk.img",
+					Mode:    0644,
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: string(body),
+			}})
+			require.Nil(t, err)
+
+			// sync
+			sync := aferosync.New(hfs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithSparse(true))...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			// assert
+			assert.Equal(t, [][2]int64{{0, 4096}, {8192, 4100}}, hfs.holes)
+			AssertEqualTars(t, expected, afs)
+		})
+	}
+}
+
+func testRegularFileAtomic(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("RegularFile/Atomic", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text1"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, ".aferosync-tmp-test.txt", []byte("some te"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithAtomicWrites(true))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				ContentChanged: true,
+				Size:           ptr(int64(10)),
+				OldSize:        ptr(int64(10)),
+				ModTime:        ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				OldModTime:     ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Mode:           ptr(fs.ModePerm),
+				OldMode:        ptr(fs.FileMode(0644)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("RegularFile/Atomic/Additive", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tars
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		expected, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./dir/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./dir/keep.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "dir/keep.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "dir/.aferosync-tmp-keep.txt", []byte("some te"), fs.ModePerm)
+		require.Nil(t, err)
+		for _, name := range []string{"dir/keep.txt", "dir"} {
+			err = afs.Chtimes(name, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithAtomicWrites(true), aferosync.WithAdditive(true))...)
+		updates, err := sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Added:   true,
+				ModTime: ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				Mode:    ptr(fs.ModePerm),
+				Size:    ptr(int64(9)),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, expected, afs)
+	})
+}
+
+func testDirAdd(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Add", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0755,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Added:   true,
+				Mode:    ptr(0755 | fs.ModeDir),
+				ModTime: ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirDelete(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Delete", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar(nil)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.MkdirAll("etc/sub", 0755)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "etc/sub/test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Deleted: true,
+				OldType: fs.ModeDir,
+			},
+		}, {
+			Path: "etc/sub",
+			Update: aferosync.Update{
+				Deleted: true,
+				OldType: fs.ModeDir,
+			},
+		}, {
+			Path: "etc/sub/test.txt",
+			Update: aferosync.Update{
+				Deleted:    true,
+				OldSize:    ptr(int64(9)),
+				FreedBytes: 9,
+			},
+		}}, updates)
+		assert.Equal(t, aferosync.Summary{Deleted: 3, BytesFreed: 9}, summary(sync))
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirDeleteRollup(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Delete/Rollup", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar(nil)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.MkdirAll("etc/sub", 0755)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "etc/sub/test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "etc/test.txt", []byte("some text2"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithDeleteRollup(true))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Deleted:     true,
+				OldType:     fs.ModeDir,
+				Descendants: 3,
+				FreedBytes:  19,
+			},
+		}}, updates)
+		assert.Equal(t, "deleted etc type=dir descendants=3 freed=19", updates[0].String())
+		assert.Equal(t, aferosync.Summary{Deleted: 4, BytesFreed: 19}, summary(sync))
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirChmod(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Chmod", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Mode:    ptr(fs.ModePerm | fs.ModeDir),
+				OldMode: ptr(0644 | fs.ModeDir),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirOverwriteRegularFile(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Overwrite/RegularFile", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0755,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		require.Nil(t, afero.WriteFile(afs, "etc", []byte("some text"), fs.ModePerm))
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Replaced:   true,
+				OldType:    0,
+				NewType:    fs.ModeDir,
+				FreedBytes: 9,
+				Mode:       ptr(0755 | fs.ModeDir),
+				ModTime:    ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirOverwriteSymlink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Overwrite/Symlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0755,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		require.Nil(t, afs.(afero.Symlinker).SymlinkIfPossible("/target", "etc"))
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Replaced: true,
+				OldType:  fs.ModeSymlink,
+				NewType:  fs.ModeDir,
+				Mode:     ptr(0755 | fs.ModeDir),
+				ModTime:  ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirChown(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Chown", func(t *testing.T) {
+		requireCaps(t, afs, capOwnership)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				Uid:     1000,
+				Gid:     1000,
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		fi, err := afs.Stat("etc")
+		require.Nil(t, err)
+		owner := fi.(aferosync.FileInfoOwner)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				Uid:    ptr(1000),
+				Gid:    ptr(1000),
+				OldUid: ptr(owner.Uid()),
+				OldGid: ptr(owner.Gid()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirModTime(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/ModTime", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "etc",
+			Update: aferosync.Update{
+				ModTime:    ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				OldModTime: ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+			},
+		}}, updates)
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirNoop(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Noop", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate(nil), updates)
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirPreserveModTime(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/PreserveModTime", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/var/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "etc/todelete", []byte("some more text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirPreserveModTimeAlternating(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/PreserveModTime/Alternating", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		dirs := []string{"a", "b", "a/deep", "a/deep/dir"}
+		files := []struct {
+			Header tar.Header
+			Body   string
+		}{}
+		for _, dir := range dirs {
+			files = append(files, struct {
+				Header tar.Header
+				Body   string
+			}{
+				Header: tar.Header{
+					Name:     "./" + dir + "/",
+					Typeflag: tar.TypeDir,
+					Mode:     0755,
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			})
+		}
+		for _, name := range []string{"a/x", "b/y", "a/z", "b/w"} {
+			files = append(files, struct {
+				Header tar.Header
+				Body   string
+			}{
+				Header: tar.Header{
+					Name:    "./" + name,
+					Mode:    0644,
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			})
+		}
+		bts, err := NewTar(files)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.MkdirAll("a/deep/dir", 0755)
+		require.Nil(t, err)
+		err = afs.Mkdir("b", 0755)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "a/deep/dir/todelete", []byte("some text"), 0644)
+		require.Nil(t, err)
+		for _, dir := range dirs {
+			err = afs.Chtimes(dir, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		for _, dir := range dirs {
+			fi, err := afs.Stat(dir)
+			require.Nil(t, err)
+			assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), fi.ModTime().Local(), dir)
+		}
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirPreserveModTimeReplaced(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	// entries = a/, a/b/, a/b/f and then a replaced by file
+	entries := func(file tar.Header) []struct {
+		Header tar.Header
+		Body   string
+	} {
+		return []struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./a/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:     "./a/b/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./a/b/f",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: file,
+		}}
+	}
+
+	t.Run("Dir/PreserveModTime/Replaced/RegularFile", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		file := tar.Header{
+			Name:    "./a",
+			Mode:    0644,
+			ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		bts, err := NewTar(entries(file))
+		require.Nil(t, err)
+		expected, err := NewTar(entries(file)[3:])
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		AssertEqualTars(t, expected, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/Replaced/Symlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		target := []struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./t/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:     "./t/b/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}}
+		link := tar.Header{
+			Name:     "./a",
+			Typeflag: tar.TypeSymlink,
+			Linkname: "t",
+			Mode:     int64(fs.ModePerm),
+			ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		bts, err := NewTar(append(target, entries(link)...))
+		require.Nil(t, err)
+		expected, err := NewTar(append(target, entries(link)[3:]...))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		fi, err := afs.Stat("t/b")
+		require.Nil(t, err)
+		assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local(), fi.ModTime().Local())
+
+		AssertEqualTars(t, expected, afs)
+	})
+}
+
+func testDirDeferred(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/Deferred", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./ro/",
+				Typeflag: tar.TypeDir,
+				Mode:     0555,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:     "./ro/sub/",
+				Typeflag: tar.TypeDir,
+				Mode:     0555,
+				ModTime:  time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./ro/sub/test.txt",
+				Mode:    0444,
+				ModTime: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("ro", 0555)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "ro/todelete", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("ro", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithDeferredDirs(true))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, aferosync.PathUpdate{
+			Path: "ro",
+			Update: aferosync.Update{
+				ModTime:    ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				OldModTime: ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+			},
+		}, updates[0])
+
+		roFileInfo, err := afs.Stat("ro")
+		require.Nil(t, err)
+		assert.Equal(t, fs.ModeDir|0555, roFileInfo.Mode())
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), roFileInfo.ModTime().Local())
+
+		subFileInfo, err := afs.Stat("ro/sub")
+		require.Nil(t, err)
+		assert.Equal(t, fs.ModeDir|0555, subFileInfo.Mode())
+		assert.Equal(t, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC).Local(), subFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirPreserveModTimeSymlink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/PreserveModTime/Symlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "./etc/symlink",
+				Linkname: "/target",
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/RegularFileOverwriteSymlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/test.txt",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "etc/test.txt")
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/RegularFileOverwriteDir", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/test.txt",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.Mkdir("etc/test.txt", fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/DirOverwriteRegularFile", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/dir/",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "etc/dir", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/DirOverwriteSymlink", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/dir/",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.(afero.Symlinker).SymlinkIfPossible("./target", "etc/dir")
+		require.Nil(t, err)
+		err = afs.Chtimes("etc/dir", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/SymlinkOverwriteDir", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "./etc/symlink",
+				Linkname: "/target",
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.Mkdir("etc/symlink", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc/symlink", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("Dir/PreserveModTime/SymlinkOverwriteRegularFile", func(t *testing.T) {
+		requireCaps(t, afs, capSymlinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "./etc/symlink",
+				Linkname: "/target",
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		afero.WriteFile(afs, "etc/symlink", []byte("some text"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testDirPreserveModTimeHardLink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Dir/PreserveModTime/HardLink", func(t *testing.T) {
+		requireCaps(t, afs, capHardLinks)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./etc/",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     "./etc/hardlink",
+				Linkname: "./etc/test.txt",
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("etc", 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("etc", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		etcFileInfo, err := afs.Stat("etc")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), etcFileInfo.ModTime().Local())
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testSymlink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Symlink", func(t *testing.T) {
+		t.Run("Add", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Typeflag: tar.TypeSymlink,
+					Name:     "./link",
+					Linkname: "/target",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Added:   true,
+					ModTime: ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+					Link:    ptr("/target"),
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar(nil)
+			require.Nil(t, err)
+
+			// build disk
+			err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "link")
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Deleted: true,
+					OldType: fs.ModeSymlink,
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Chown", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks|capOwnership)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Typeflag: tar.TypeSymlink,
+					Name:     "./link",
+					Linkname: "/target",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					Uid:      1000,
+					Gid:      1000,
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "link")
+			require.Nil(t, err)
+			err = afs.Chtimes("link", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			fi, _, err := afs.(afero.Symlinker).LstatIfPossible("link")
+			require.Nil(t, err)
+			owner := fi.(aferosync.FileInfoOwner)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Uid:    ptr(1000),
+					Gid:    ptr(1000),
+					OldUid: ptr(owner.Uid()),
+					OldGid: ptr(owner.Gid()),
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("ModTime", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Typeflag: tar.TypeSymlink,
+					Name:     "./link",
+					Linkname: "/target",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "link")
+			require.Nil(t, err)
+			err = afs.Chtimes("link", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					ModTime:    ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+					OldModTime: ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Overwrite", func(t *testing.T) {
+			t.Run("Symlink", func(t *testing.T) {
+				requireCaps(t, afs, capSymlinks)
+
+				err := Clear(afs)
+				require.Nil(t, err)
+
+				// build tar
+				bts, err := NewTar([]struct {
+					Header tar.Header
+					Body   string
+				}{{
+					Header: tar.Header{
+						Typeflag: tar.TypeSymlink,
+						Name:     "./link",
+						Linkname: "/target2",
+						Mode:     int64(fs.ModePerm),
+						ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+				}})
+				require.Nil(t, err)
+
+				// build disk
+				err = afs.(afero.Symlinker).SymlinkIfPossible("/target1", "link")
+				require.Nil(t, err)
+				err = afs.Chtimes("link", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+				require.Nil(t, err)
+
+				// sync
+				var updates []aferosync.PathUpdate
+				sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+				for sync.Next() {
+					updates = append(updates, sync.Update())
+				}
+				require.Nil(t, sync.Err())
+
+				// assert
+				assert.Equal(t, []aferosync.PathUpdate{{
+					Path: "link",
+					Update: aferosync.Update{
+						Link:    ptr("/target2"),
+						OldLink: ptr("/target1"),
+					},
+				}}, updates)
+
+				AssertEqualTars(t, bts, afs)
+			})
+
+			t.Run("RegularFile", func(t *testing.T) {
+				requireCaps(t, afs, capSymlinks)
+
+				err := Clear(afs)
+				require.Nil(t, err)
+
+				// build tar
+				bts, err := NewTar([]struct {
+					Header tar.Header
+					Body   string
+				}{{
+					Header: tar.Header{
+						Typeflag: tar.TypeSymlink,
+						Name:     "./link",
+						Linkname: "/target2",
+						Mode:     int64(fs.ModePerm),
+						ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+				}})
+				require.Nil(t, err)
+
+				// build disk
+				err = afero.WriteFile(afs, "link", []byte("some text"), fs.ModePerm)
+				require.Nil(t, err)
+				err = afs.Chtimes("link", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+				require.Nil(t, err)
+
+				// sync
+				var updates []aferosync.PathUpdate
+				sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+				for sync.Next() {
+					updates = append(updates, sync.Update())
+				}
+				require.Nil(t, sync.Err())
+
+				// assert
+				assert.Equal(t, []aferosync.PathUpdate{{
+					Path: "link",
+					Update: aferosync.Update{
+						Replaced:   true,
+						OldType:    0,
+						NewType:    fs.ModeSymlink,
+						FreedBytes: 9,
+						ModTime:    ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+						Link:       ptr("/target2"),
+					},
+				}}, updates)
+
+				AssertEqualTars(t, bts, afs)
+			})
+
+			t.Run("Dir", func(t *testing.T) {
+				requireCaps(t, afs, capSymlinks)
+
+				err := Clear(afs)
+				require.Nil(t, err)
+
+				// build tar
+				bts, err := NewTar([]struct {
+					Header tar.Header
+					Body   string
+				}{{
+					Header: tar.Header{
+						Typeflag: tar.TypeSymlink,
+						Name:     "./link",
+						Linkname: "/target2",
+						Mode:     int64(fs.ModePerm),
+						ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+				}})
+				require.Nil(t, err)
+
+				// build disk
+				err = afs.Mkdir("link", fs.ModePerm)
+				require.Nil(t, err)
+				err = afs.Chtimes("link", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+				require.Nil(t, err)
+
+				// sync
+				var updates []aferosync.PathUpdate
+				sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+				for sync.Next() {
+					updates = append(updates, sync.Update())
+				}
+				require.Nil(t, sync.Err())
+
+				// assert
+				assert.Equal(t, []aferosync.PathUpdate{{
+					Path: "link",
+					Update: aferosync.Update{
+						Replaced: true,
+						OldType:  fs.ModeDir,
+						NewType:  fs.ModeSymlink,
+						ModTime:  ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+						Link:     ptr("/target2"),
+					},
+				}}, updates)
+
+				AssertEqualTars(t, bts, afs)
+			})
+		})
+
+		t.Run("Noop", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Typeflag: tar.TypeSymlink,
+					Name:     "./link",
+					Linkname: "/target",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afs.(afero.Symlinker).SymlinkIfPossible("/target", "link")
+			require.Nil(t, err)
+			err = afs.Chtimes("link", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate(nil), updates)
+			AssertEqualTars(t, bts, afs)
+		})
+	})
+}
+
+func testLink(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Link", func(t *testing.T) {
+		t.Run("Add", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afero.WriteFile(afs, "atarget", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Added: true,
+				},
+			}}, updates)
+
+			linkfi, err := afs.Stat("link")
+			assert.Nil(t, err)
+			targetfi, err := afs.Stat("atarget")
+			assert.Nil(t, err)
+			assert.Equal(t, targetfi.(aferosync.FileInfoInoer).Ino(), linkfi.(aferosync.FileInfoInoer).Ino())
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			afero.WriteFile(afs, "atarget", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			err = afs.(aferosync.Linker).Link("/atarget", "link")
+			require.Nil(t, err)
+			fi, err := afs.Stat("link")
+			require.Nil(t, err)
+
+			// the content isn't freed while atarget links to it
+			freed := int64(9)
+			if _, ok := fi.(aferosync.FileInfoNlinker); ok {
+				freed = 0
+			}
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Deleted:    true,
+					OldSize:    ptr(int64(9)),
+					FreedBytes: freed,
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Overwrite/Link", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget1",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}, {
+				Header: tar.Header{
+					Name:    "./atarget2",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some more text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget2",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			afero.WriteFile(afs, "atarget1", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget1", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			afero.WriteFile(afs, "atarget2", []byte("some more text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget2", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			err = afs.(aferosync.Linker).Link("/atarget1", "link")
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					ContentChanged: true,
+					Size:           ptr(int64(14)),
+					OldSize:        ptr(int64(9)),
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Overwrite/RegularFile", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some more text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afero.WriteFile(afs, "atarget", []byte("some more text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			err = afero.WriteFile(afs, "link", []byte("some text"), 0644)
+			require.Nil(t, err)
+			err = afs.Chmod("link", 0644)
+			require.Nil(t, err)
+			err = afs.Chtimes("link", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					ContentChanged: true,
+					Size:           ptr(int64(14)),
+					OldSize:        ptr(int64(9)),
+					Mode:           ptr(fs.ModePerm),
+					OldMode:        ptr(fs.FileMode(0644)),
+					ModTime:        ptr(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+					OldModTime:     ptr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Local()),
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Overwrite/Dir", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			afero.WriteFile(afs, "atarget", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			err = afs.Mkdir("link", fs.ModePerm)
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Replaced: true,
+					OldType:  fs.ModeDir,
+					NewType:  0,
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Overwrite/Symlink", func(t *testing.T) {
+			requireCaps(t, afs, capSymlinks|capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			afero.WriteFile(afs, "atarget", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			err = afs.(afero.Symlinker).SymlinkIfPossible("/atarget2", "link")
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate{{
+				Path: "link",
+				Update: aferosync.Update{
+					Replaced: true,
+					OldType:  fs.ModeSymlink,
+					NewType:  0,
+				},
+			}}, updates)
+
+			AssertEqualTars(t, bts, afs)
+		})
+
+		t.Run("Noop", func(t *testing.T) {
+			requireCaps(t, afs, capHardLinks)
+
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			bts, err := NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tar.Header{
+					Name:    "./atarget",
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}, {
+				Header: tar.Header{
+					Typeflag: tar.TypeLink,
+					Name:     "./link",
+					Linkname: "./atarget",
+					Mode:     int64(fs.ModePerm),
+					ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+			}})
+			require.Nil(t, err)
+
+			// build disk
+			err = afero.WriteFile(afs, "atarget", []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes("atarget", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+			err = afs.(aferosync.Linker).Link("/atarget", "link")
+			require.Nil(t, err)
+
+			// sync
+			var updates []aferosync.PathUpdate
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			for sync.Next() {
+				updates = append(updates, sync.Update())
+			}
+			require.Nil(t, sync.Err())
+
+			// assert
+			assert.Equal(t, []aferosync.PathUpdate(nil), updates)
+			AssertEqualTars(t, bts, afs)
+		})
+	})
+}
+
+func testTarOut(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("TarOut/Dir", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "dir/test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "outside.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// tar out
+		buf := bytes.NewBuffer(nil)
+		err = aferosync.TarOut(afs, "dir", buf)
+		require.Nil(t, err)
+
+		// assert
+		files, err := ReadTar(buf.Bytes())
+		require.Nil(t, err)
+		normalizeTar(&files)
+
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Header.Name)
+		}
+		assert.Equal(t, []string{"test.txt"}, names)
+	})
+
+	t.Run("TarOut/ModTime", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 123456789, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 123456789, time.UTC))
+		require.Nil(t, err)
+
+		// tar out
+		buf := bytes.NewBuffer(nil)
+		err = aferosync.TarOut(afs, ".", buf)
+		require.Nil(t, err)
+
+		// assert
+		files, err := ReadTar(buf.Bytes())
+		require.Nil(t, err)
+		normalizeTar(&files)
+
+		require.Len(t, files, 1)
+		assert.True(t, time.Date(2025, 1, 1, 0, 0, 0, 123456789, time.UTC).Equal(files[0].Header.ModTime))
+	})
+
+	t.Run("TarOut/Reproducible", func(t *testing.T) {
+		c := detect(afs)
+		treeCfg := TreeConfig{
+			Symlinks:  c&capSymlinks != 0,
+			HardLinks: c&capHardLinks != 0,
+			Ownership: c&capOwnership != 0,
+		}
+
+		r := rand.New(rand.NewPCG(2, 0))
+		for range 20 {
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			err = RandomTree(r, treeCfg).WriteFs(afs)
+			require.Nil(t, err)
+
+			buf := bytes.NewBuffer(nil)
+			digest, err := aferosync.TarOutDigest(afs, ".", buf)
+			require.Nil(t, err)
+			bts := buf.Bytes()
+
+			// the same tree gives the same archive
+			buf = bytes.NewBuffer(nil)
+			digest2, err := aferosync.TarOutDigest(afs, ".", buf)
+			require.Nil(t, err)
+			assert.Equal(t, digest, digest2)
+			assert.Equal(t, bts, buf.Bytes())
+
+			// so does the same tree synced into an empty fs
+			err = Clear(afs)
+			require.Nil(t, err)
+
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			buf = bytes.NewBuffer(nil)
+			digest3, err := aferosync.TarOutDigest(afs, ".", buf)
+			require.Nil(t, err)
+			assert.Equal(t, digest, digest3)
+
+			// entries are sorted, without user names or access and change times
+			files, err := ReadTar(bts)
+			require.Nil(t, err)
+			for i, file := range files {
+				if i > 0 {
+					assert.Less(t, files[i-1].Header.Name, file.Header.Name)
+				}
+				assert.Empty(t, file.Header.Uname)
+				assert.Empty(t, file.Header.Gname)
+				assert.True(t, file.Header.AccessTime.IsZero())
+				assert.True(t, file.Header.ChangeTime.IsZero())
+			}
+		}
+	})
+
+	t.Run("TarOut/MaxModTime", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "new.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("new.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "old.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("old.txt", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// tar out
+		buf := bytes.NewBuffer(nil)
+		_, err = aferosync.TarOutDigest(afs, ".", buf, aferosync.WithTarMaxModTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+		require.Nil(t, err)
+
+		// assert
+		files, err := ReadTar(buf.Bytes())
+		require.Nil(t, err)
+
+		modTimes := map[string]time.Time{}
+		for _, file := range files {
+			modTimes[file.Header.Name] = file.Header.ModTime.UTC()
+		}
+		assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), modTimes["./new.txt"])
+		assert.Equal(t, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), modTimes["./old.txt"])
+	})
+
+	t.Run("TarOut/RoundTrip", func(t *testing.T) {
+		c := detect(afs)
+		treeCfg := TreeConfig{
+			Symlinks:  c&capSymlinks != 0,
+			HardLinks: c&capHardLinks != 0,
+			Ownership: c&capOwnership != 0,
+		}
+
+		r := rand.New(rand.NewPCG(1, 0))
+		for range 20 {
+			err := Clear(afs)
+			require.Nil(t, err)
+
+			tree := RandomTree(r, treeCfg)
+			err = tree.WriteFs(afs)
+			require.Nil(t, err)
+
+			treeBts, err := tree.Tar()
+			require.Nil(t, err)
+			AssertEqualTars(t, treeBts, afs)
+
+			buf := bytes.NewBuffer(nil)
+			err = aferosync.TarOut(afs, ".", buf)
+			require.Nil(t, err)
+			bts := buf.Bytes()
+
+			// sync the image back into an empty fs
+			err = Clear(afs)
+			require.Nil(t, err)
+
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			AssertEqualTars(t, bts, afs)
+		}
+	})
+}
+
+func testSummary(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Summary", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test1.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./test4.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./test5.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./test6.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./test7.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		err = afero.WriteFile(afs, "test2.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test3.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test4.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test4.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test5.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test5.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test6.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test6.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "test7.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test7.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), opts...)
+		for sync.Next() {
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, aferosync.Summary{
+			Added:        1,
+			Deleted:      2,
+			Updated:      3,
+			Unchanged:    1,
+			Files:        5,
+			ModeChanges:  3,
+			BytesRead:    45,
+			BytesWritten: 9,
+			BytesFreed:   18,
+		}, summary(sync))
+
+		AssertEqualTars(t, bts, afs)
+	})
+}
+
+func testSummaryCounts(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Summary/Counts", func(t *testing.T) {
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./a.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some new text",
+		}, {
+			Header: tar.Header{
+				Name:    "./b.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:     "./c/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:     "./d",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "a.txt",
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "a.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("a.txt", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "b.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("b.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithSymlinks(false))...)
+		for sync.Next() {
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, aferosync.Summary{
+			Added:          1,
+			Updated:        1,
+			Unchanged:      1,
+			Skipped:        1,
+			Files:          2,
+			Dirs:           1,
+			ModTimeChanges: 1,
+			ContentChanges: 1,
+			BytesRead:      22,
+			BytesWritten:   13,
+		}, summary(sync))
+		assert.Positive(t, sync.Summary().Duration)
+
+		bts, err = json.Marshal(sync.Summary())
+		require.Nil(t, err)
+		assert.Contains(t, string(bts), `"unchanged":1,"skipped":1,"files":2,"dirs":1`)
+	})
+}
+
+func testXattrs(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Xattrs", func(t *testing.T) {
+		requireCaps(t, afs, capXattrs)
+
+		err := Clear(afs)
+		require.Nil(t, err)
+
+		xattrer := afs.(aferosync.Xattrer)
+
+		// build tar
+		bts, err := NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./ping",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+					"SCHILY.xattr.user.keep":           "value",
+				},
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "ping", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("ping", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = xattrer.Setxattr("ping", "user.keep", []byte("value"))
+		require.Nil(t, err)
+		err = xattrer.Setxattr("ping", "user.stale", []byte("value"))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithXattrs(true))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "ping",
+			Update: aferosync.Update{
+				Xattrs: []string{"security.capability", "user.stale"},
+			},
+		}}, updates)
+
+		names, err := xattrer.Listxattr("ping")
+		require.Nil(t, err)
+		sort.Strings(names)
+		assert.Equal(t, []string{"security.capability", "user.keep"}, names)
+
+		capability, err := xattrer.Getxattr("ping", "security.capability")
+		require.Nil(t, err)
+		assert.Equal(t, []byte("\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), capability)
+	})
+}
@@ -17,6 +17,10 @@ func AllPaths(afs afero.Fs) ([]string, error) {
 		return allPathser.AllPaths()
 	}
 
+	return walkPaths(afs)
+}
+
+func walkPaths(afs afero.Fs) ([]string, error) {
 	var paths []string
 	if err := afero.Walk(afs, ".", func(path string, info fs.FileInfo, err error) error {
 		paths = append(paths, path)
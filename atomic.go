@@ -0,0 +1,73 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const tempPrefix = ".aferosync-tmp-"
+
+// tempPath returns the sibling temp file path that path's new content is written to before it's
+// renamed over path.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), tempPrefix+filepath.Base(path))
+}
+
+func isTempPath(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), tempPrefix)
+}
+
+// writeRegularFileAtomic writes the content read from r and the metadata of hdr's file to a temp
+// file and renames it over the target so that an interruption never leaves a half-written file
+// behind.
+func (s *Sync) writeRegularFileAtomic(hdr *tar.Header, r io.Reader) error {
+	path := normalizePath(hdr.Name)
+	tmpPath := tempPath(path)
+
+	if err := s.writeFile(tmpPath, r, hdr.Size); err != nil {
+		s.fs.Remove(tmpPath)
+		return fmt.Errorf("failed to write file: %s: %w", tmpPath, err)
+	}
+
+	if err := s.syncStatAt(tmpPath, hdr, nil); err != nil {
+		s.fs.Remove(tmpPath)
+		return fmt.Errorf("failed to sync stat: %w", err)
+	}
+
+	if err := s.fs.Rename(tmpPath, path); err != nil {
+		s.fs.Remove(tmpPath)
+		return fmt.Errorf("failed to rename: %s: %w", tmpPath, err)
+	}
+
+	return nil
+}
+
+// removeTempFiles removes temp files left behind by interrupted syncs and drops them from pathMap,
+// the paths of the whole fs, so that they aren't reported as deleted.
+func (s *Sync) removeTempFiles(pathMap map[string]struct{}) error {
+	var tmpPaths []string
+	for path := range pathMap {
+		if isTempPath(path) {
+			tmpPaths = append(tmpPaths, path)
+		}
+	}
+	sort.Strings(tmpPaths)
+
+	for _, path := range tmpPaths {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+
+		if err := s.fs.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove temp file: %s: %w", path, err)
+		}
+
+		delete(pathMap, path)
+	}
+
+	return nil
+}
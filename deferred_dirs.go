@@ -0,0 +1,65 @@
+package aferosync
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deferredDir is the final mode and modtime of a directory, applied once all its children have
+// been written.
+type deferredDir struct {
+	path    string
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// makeDirWritable gives the owner full access to the directory at path so that its children can
+// be written before its deferred mode is applied.
+func (s *Sync) makeDirWritable(path string) error {
+	fi, _, err := LstatOrStat(s.fs, path)
+	if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", path, err)
+	}
+
+	if fi.Mode().Perm()&0700 == 0700 {
+		return nil
+	}
+
+	if err := s.fs.Chmod(path, fi.Mode()|0700); err != nil {
+		return fmt.Errorf("failed to chmod: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyDeferredDirs sets the final mode and modtime of deferred directories, deepest first.
+func (s *Sync) applyDeferredDirs() error {
+	sort.SliceStable(s.deferredDirs, func(i, j int) bool {
+		return strings.Count(s.deferredDirs[i].path, "/") > strings.Count(s.deferredDirs[j].path, "/")
+	})
+
+	for _, dir := range s.deferredDirs {
+		fi, _, err := LstatOrStat(s.fs, dir.path)
+		if err != nil {
+			return fmt.Errorf("failed to stat: %s: %w", dir.path, err)
+		}
+
+		if fi.Mode() != dir.mode {
+			if err := s.fs.Chmod(dir.path, dir.mode); err != nil {
+				return fmt.Errorf("failed to chmod: %s: %w", dir.path, err)
+			}
+		}
+
+		if !fi.ModTime().Equal(dir.modTime) {
+			if err := s.fs.Chtimes(dir.path, dir.modTime, dir.modTime); err != nil {
+				return fmt.Errorf("failed to chtimes: %s: %w", dir.path, err)
+			}
+		}
+	}
+
+	s.deferredDirs = nil
+	return nil
+}
@@ -0,0 +1,143 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/gaboose/aferosync/memfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failStatFs fails to stat a single path. It hides the optional interfaces of Fs.
+type failStatFs struct {
+	afero.Fs
+	fail string
+}
+
+func (f *failStatFs) Stat(name string) (os.FileInfo, error) {
+	if filepath.Clean(name) == f.fail {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: syscall.EACCES}
+	}
+	return f.Fs.Stat(name)
+}
+
+func TestDeleteStatError(t *testing.T) {
+	afs := memfs.New()
+	err := afero.WriteFile(afs, "test.txt", []byte("some text"), 0644)
+	require.Nil(t, err)
+
+	bts, err := aferosynctest.NewTar(nil)
+	require.Nil(t, err)
+
+	ffs := &failStatFs{Fs: afs, fail: "test.txt"}
+	sync := aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts)), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false), aferosync.WithOwnership(false))
+	updates, err := sync.Run()
+	assert.ErrorIs(t, err, syscall.EACCES)
+	assert.Empty(t, updates)
+
+	// a path that can't be stat'ed is left alone
+	_, err = afs.Stat("test.txt")
+	assert.Nil(t, err)
+}
+
+func TestDeleteUnderReplacedAncestor(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		entry tar.Header
+	}{{
+		name: "RegularFile",
+		entry: tar.Header{
+			Name: "./a",
+			Mode: 0644,
+		},
+	}, {
+		name: "Symlink",
+		entry: tar.Header{
+			Name:     "./a",
+			Typeflag: tar.TypeSymlink,
+			Linkname: "t",
+			Mode:     0777,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			afs := memfs.New()
+			err := afs.MkdirAll("a", 0755)
+			require.Nil(t, err)
+			err = afero.WriteFile(afs, "a/x", []byte("some text"), 0644)
+			require.Nil(t, err)
+			err = afs.MkdirAll("t", 0755)
+			require.Nil(t, err)
+			err = afero.WriteFile(afs, "t/x", []byte("some text"), 0644)
+			require.Nil(t, err)
+
+			bts, err := aferosynctest.NewTar([]struct {
+				Header tar.Header
+				Body   string
+			}{{
+				Header: tc.entry,
+			}, {
+				Header: tar.Header{
+					Name:     "./t/",
+					Typeflag: tar.TypeDir,
+					Mode:     0755,
+				},
+			}, {
+				Header: tar.Header{
+					Name: "./t/x",
+					Mode: 0644,
+				},
+				Body: "some text",
+			}})
+			require.Nil(t, err)
+
+			// a/x is gone with a, deleting it must not follow a to t/x
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)))
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			aferosynctest.AssertEqualTars(t, bts, afs)
+		})
+	}
+}
+
+func TestReplaceOrder(t *testing.T) {
+	afs := memfs.New()
+	err := afs.MkdirAll("a/sub", 0755)
+	require.Nil(t, err)
+	err = afero.WriteFile(afs, "a/sub/x", []byte("some text"), 0644)
+	require.Nil(t, err)
+	err = afero.WriteFile(afs, "a/y", []byte("some text"), 0644)
+	require.Nil(t, err)
+
+	bts, err := aferosynctest.NewTar([]struct {
+		Header tar.Header
+		Body   string
+	}{{
+		Header: tar.Header{Name: "./a", Mode: 0644},
+	}, {
+		Header: tar.Header{Name: "./b", Mode: 0644},
+	}})
+	require.Nil(t, err)
+
+	updates, err := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts))).Run()
+	require.Nil(t, err)
+
+	// the descendants of a replaced directory follow it, before the next entry
+	var paths []string
+	for _, upd := range updates {
+		paths = append(paths, upd.Path)
+	}
+	assert.Equal(t, []string{"a", "a/sub", "a/sub/x", "a/y", "b"}, paths)
+	assert.True(t, updates[0].Replaced)
+	assert.True(t, updates[1].Deleted)
+	assert.True(t, updates[4].Added)
+}
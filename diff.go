@@ -0,0 +1,61 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+// DiffTars compares the tar archives a and b without a destination fs. It returns a Sync that
+// yields the updates syncing b over a tree extracted from a would produce. a is indexed in memory
+// by its headers, content is only kept for the files WithContentDiff diffs. Options that read other
+// content of a, like WithUndo and WithLayer, fail, use DiffTarsFs for them.
+func DiffTars(a, b *tar.Reader, opts ...Option) *Sync {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fsys := newIndexFs(o.contentDiffMaxSize)
+	if err := indexTar(fsys, a, opts); err != nil {
+		return &Sync{err: err}
+	}
+
+	// b's content isn't needed once written
+	fsys.keepSize = 0
+
+	// the index is thrown away anyway, and a dry run would copy up content that isn't kept
+	if o.layerWriter == nil {
+		opts = append(opts, WithDryRun(false))
+	}
+
+	return New(fsys, b, opts...)
+}
+
+// DiffTarsFs is like DiffTars but indexes a in fsys, which should be empty. It's synced over with
+// opts, so fsys has to implement the optional interfaces the enabled features need.
+func DiffTarsFs(fsys afero.Fs, a, b *tar.Reader, opts ...Option) *Sync {
+	if err := indexTar(fsys, a, opts); err != nil {
+		return &Sync{err: err}
+	}
+
+	return New(fsys, b, opts...)
+}
+
+// indexTar extracts a into fsys. Only b's sync writes undo archives, journals, layers and events.
+func indexTar(fsys afero.Fs, a *tar.Reader, opts []Option) error {
+	index := func(o *options) {
+		o.withDryRun = false
+		o.layerWriter = nil
+		o.undoWriter = nil
+		o.withJournal = false
+		o.eventWriter = nil
+	}
+
+	if _, err := New(fsys, a, append(opts, index)...).Run(); err != nil {
+		return fmt.Errorf("failed to index tar: %w", err)
+	}
+
+	return nil
+}
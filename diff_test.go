@@ -0,0 +1,249 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDiffTars(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("DiffTars", func(t *testing.T) {
+		treeCfg := aferosynctest.TreeConfig{Symlinks: true, HardLinks: true, Ownership: true}
+
+		r := rand.New(rand.NewPCG(5, 0))
+		for range 20 {
+			err := aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			a := aferosynctest.RandomTree(r, treeCfg)
+			b := aferosynctest.MutateTree(r, a, treeCfg)
+			aBts, err := a.Tar()
+			require.Nil(t, err)
+			bBts, err := b.Tar()
+			require.Nil(t, err)
+
+			// diff in memory
+			diff := aferosync.DiffTars(tar.NewReader(bytes.NewBuffer(aBts)), tar.NewReader(bytes.NewBuffer(bBts)), opts...)
+			memUpdates, err := diff.Run()
+			require.Nil(t, err)
+
+			// diff in afs
+			diff = aferosync.DiffTarsFs(afs, tar.NewReader(bytes.NewBuffer(aBts)), tar.NewReader(bytes.NewBuffer(bBts)), opts...)
+			fsUpdates, err := diff.Run()
+			require.Nil(t, err)
+
+			// sync
+			err = aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(aBts)), opts...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			sync = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), opts...)
+			updates, err := sync.Run()
+			require.Nil(t, err)
+
+			assert.Equal(t, updates, fsUpdates)
+			assert.Equal(t, updates, memUpdates)
+		}
+	})
+}
+
+func TestDiffTarsContentDiff(t *testing.T) {
+	// build tars
+	tars := [2][]byte{}
+	for i, hosts := range []string{
+		"127.0.0.1 localhost\n10.0.0.1 db\n",
+		"127.0.0.1 localhost\n10.0.0.2 db\n",
+	} {
+		var err error
+		tars[i], err = aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./hosts",
+				Mode:    0644,
+				ModTime: time.Date(2024+i, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: hosts,
+		}, {
+			Header: tar.Header{
+				Name:    "./large.txt",
+				Mode:    0644,
+				ModTime: time.Date(2024+i, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: strings.Repeat(string(rune('x'+i)), 100),
+		}})
+		require.Nil(t, err)
+	}
+
+	// diff
+	diff := aferosync.DiffTars(tar.NewReader(bytes.NewBuffer(tars[0])), tar.NewReader(bytes.NewBuffer(tars[1])), aferosync.WithContentDiff(64))
+	updates, err := diff.Run()
+	require.Nil(t, err)
+
+	// assert
+	diffs := map[string]string{}
+	for _, upd := range updates {
+		assert.True(t, upd.ContentChanged)
+		diffs[upd.Path] = upd.Diff
+	}
+	assert.Equal(t, map[string]string{
+		"hosts": "--- a/hosts\n" +
+			"+++ b/hosts\n" +
+			"@@ -1,2 +1,2 @@\n" +
+			" 127.0.0.1 localhost\n" +
+			"-10.0.0.1 db\n" +
+			"+10.0.0.2 db\n",
+		"large.txt": "",
+	}, diffs)
+}
+
+func TestDiffTarsMemory(t *testing.T) {
+	const size = 64 << 20
+
+	// bigTar streams a tar with a single file of size bytes
+	bigTar := func(modTime time.Time) *tar.Reader {
+		r, w := io.Pipe()
+		go func() {
+			tw := tar.NewWriter(w)
+			err := tw.WriteHeader(&tar.Header{Name: "./big.bin", Mode: 0644, Size: size, ModTime: modTime})
+			if err == nil {
+				_, err = io.CopyN(tw, fillReader('x'), size)
+			}
+			if err == nil {
+				err = tw.Close()
+			}
+			w.CloseWithError(err)
+		}()
+		return tar.NewReader(r)
+	}
+
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+
+	diff := aferosync.DiffTars(bigTar(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)), bigTar(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)))
+	updates, err := diff.Run()
+	require.Nil(t, err)
+
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+
+	// the content of neither tar is kept
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+
+	require.Len(t, updates, 1)
+	assert.True(t, updates[0].ContentChanged)
+	assert.Equal(t, int64(size), *updates[0].Size)
+	assert.Equal(t, int64(size), *updates[0].OldSize)
+}
+
+// fillReader reads as an endless stream of its byte.
+type fillReader byte
+
+func (r fillReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func testContentDiff(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ContentDiff/Atomic=%t", atomic), func(t *testing.T) {
+			err := aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			// build tar
+			entries := []struct {
+				Header tar.Header
+				Body   string
+			}{}
+			for _, e := range []struct{ name, body string }{
+				{"./binary.bin", "a\x00c"},
+				{"./hosts", "127.0.0.1 localhost\n::1 localhost\n10.0.0.2 db\n"},
+				{"./large.txt", strings.Repeat("y", 100)},
+				{"./noeol.txt", "one\ntwo"},
+			} {
+				entries = append(entries, struct {
+					Header tar.Header
+					Body   string
+				}{
+					Header: tar.Header{
+						Name:    e.name,
+						Mode:    0644,
+						ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+					},
+					Body: e.body,
+				})
+			}
+			bts, err := aferosynctest.NewTar(entries)
+			require.Nil(t, err)
+
+			// build disk
+			for name, body := range map[string]string{
+				"binary.bin": "a\x00b",
+				"hosts":      "127.0.0.1 localhost\n::1 localhost\n10.0.0.1 db\n",
+				"large.txt":  strings.Repeat("x", 100),
+				"noeol.txt":  "one\n",
+			} {
+				err = afero.WriteFile(afs, name, []byte(body), 0644)
+				require.Nil(t, err)
+			}
+
+			// sync
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)),
+				append(opts, aferosync.WithContentDiff(64), aferosync.WithAtomicWrites(atomic))...)
+			updates, err := sync.Run()
+			require.Nil(t, err)
+
+			// assert
+			aferosynctest.AssertEqualTars(t, bts, afs)
+
+			diffs := map[string]string{}
+			var hosts aferosync.PathUpdate
+			for _, upd := range updates {
+				diffs[upd.Path] = upd.Diff
+				if upd.Path == "hosts" {
+					hosts = upd
+				}
+			}
+			assert.Equal(t, map[string]string{
+				"binary.bin": "",
+				"hosts": "--- a/hosts\n" +
+					"+++ b/hosts\n" +
+					"@@ -1,3 +1,3 @@\n" +
+					" 127.0.0.1 localhost\n" +
+					" ::1 localhost\n" +
+					"-10.0.0.1 db\n" +
+					"+10.0.0.2 db\n",
+				"large.txt": "",
+				"noeol.txt": "--- a/noeol.txt\n" +
+					"+++ b/noeol.txt\n" +
+					"@@ -1 +1,2 @@\n" +
+					" one\n" +
+					"+two\n" +
+					"\\ No newline at end of file\n",
+			}, diffs)
+
+			report := &bytes.Buffer{}
+			err = aferosync.WriteReport(report, []aferosync.PathUpdate{hosts})
+			require.Nil(t, err)
+			assert.Equal(t, hosts.String()+"\n"+hosts.Diff, report.String())
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package aferosync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// touchDir records the original modtime of dir before one of its entries is modified. If dir
+// doesn't exist yet, the nearest existing ancestor is recorded instead since that's the
+// directory that gets modified when dir is created. Each directory is stat'ed only once.
+func (s *Sync) touchDir(dir string) error {
+	for {
+		if _, ok := s.dirModTimes[dir]; ok {
+			s.baseDirPath = dir
+			return nil
+		}
+
+		fi, _, err := LstatOrStat(s.fs, dir)
+		if errors.Is(err, fs.ErrNotExist) && dir != "." {
+			dir = filepath.Dir(dir)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to stat base dir: %s: %w", dir, err)
+		}
+
+		if s.dirModTimes == nil {
+			s.dirModTimes = map[string]time.Time{}
+		}
+		s.dirModTimes[dir] = fi.ModTime()
+		s.baseDirPath = dir
+
+		if s.journal != nil {
+			return s.journal.recordDir(dir, fi.ModTime())
+		}
+		return nil
+	}
+}
+
+// untouchDir stops tracking path and the directories below it, e.g. because they have been
+// removed.
+func (s *Sync) untouchDir(path string) {
+	for dir := range s.dirModTimes {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			delete(s.dirModTimes, dir)
+		}
+	}
+}
+
+// restoreDirModTimes restores the recorded modtimes of all touched directories in a single pass.
+// Directories that have since been removed or replaced by another type of file, like a symlink that
+// mustn't be followed, are ignored.
+func (s *Sync) restoreDirModTimes() error {
+	dirs := make([]string, 0, len(s.dirModTimes))
+	for dir := range s.dirModTimes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		fi, _, err := LstatOrStat(s.fs, dir)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to stat base dir: %s: %w", dir, err)
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		modTime := s.dirModTimes[dir]
+		if err := s.fs.Chtimes(dir, modTime, modTime); err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return fmt.Errorf("failed to preserve base dir modtime: %s: %w", dir, err)
+		}
+	}
+
+	s.dirModTimes = nil
+	s.baseDirPath = ""
+	return nil
+}
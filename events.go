@@ -0,0 +1,270 @@
+package aferosync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// EventVersion is the version of the event schema. It's incremented on changes that older decoders
+// would misread, new optional fields don't change it.
+const EventVersion = 1
+
+type EventKind string
+
+const (
+	EventAdded    EventKind = "added"
+	EventUpdated  EventKind = "updated"
+	EventDeleted  EventKind = "deleted"
+	EventReplaced EventKind = "replaced"
+
+	// EventSummary ends the stream of a completed sync, EventError the stream of a failed one
+	EventSummary EventKind = "summary"
+	EventError   EventKind = "error"
+)
+
+// Event is a record of the NDJSON event stream written by Encoder. Update events carry the path,
+// the changed attributes under New and their old values under Old, summary events the Summary and
+// error events the error message.
+type Event struct {
+	Version int       `json:"v"`
+	Kind    EventKind `json:"kind"`
+	Path    string    `json:"path,omitempty"`
+
+	Old *EventAttrs `json:"old,omitempty"`
+	New *EventAttrs `json:"new,omitempty"`
+
+	ContentChanged bool     `json:"content_changed,omitempty"`
+	Xattrs         []string `json:"xattrs,omitempty"`
+	Descendants    int      `json:"descendants,omitempty"`
+	FreedBytes     int64    `json:"freed_bytes,omitempty"`
+	Diff           string   `json:"diff,omitempty"`
+
+	Summary *Summary `json:"summary,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// EventAttrs are the attributes of a file in an Event. Type is "file", "dir", "symlink", "pipe",
+// "socket", "device" or "chardevice", and Mode the permission and special bits in octal like
+// chmod, e.g. "0644". ModTime is in RFC 3339 format.
+type EventAttrs struct {
+	Type    string     `json:"type,omitempty"`
+	Mode    string     `json:"mode,omitempty"`
+	Uid     *int       `json:"uid,omitempty"`
+	Gid     *int       `json:"gid,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+	Link    *string    `json:"link,omitempty"`
+	Size    *int64     `json:"size,omitempty"`
+}
+
+// NewUpdateEvent returns the event of upd.
+func NewUpdateEvent(upd PathUpdate) Event {
+	e := Event{
+		Version:        EventVersion,
+		Kind:           EventUpdated,
+		Path:           upd.Path,
+		ContentChanged: upd.ContentChanged,
+		Xattrs:         upd.Xattrs,
+		Descendants:    upd.Descendants,
+		FreedBytes:     upd.FreedBytes,
+		Diff:           upd.Diff,
+	}
+
+	if upd.Added {
+		e.Kind = EventAdded
+	} else if upd.Deleted {
+		e.Kind = EventDeleted
+	} else if upd.Replaced {
+		e.Kind = EventReplaced
+	}
+
+	oldAttrs := EventAttrs{
+		Uid:     upd.OldUid,
+		Gid:     upd.OldGid,
+		ModTime: upd.OldModTime,
+		Link:    upd.OldLink,
+		Size:    upd.OldSize,
+	}
+	if upd.Deleted || upd.Replaced {
+		oldAttrs.Type = typeName(upd.OldType)
+	}
+	if upd.OldMode != nil {
+		oldAttrs.Type = typeName(upd.OldMode.Type())
+		oldAttrs.Mode = octalMode(*upd.OldMode)
+	}
+
+	newAttrs := EventAttrs{
+		Uid:     upd.Uid,
+		Gid:     upd.Gid,
+		ModTime: upd.ModTime,
+		Link:    upd.Link,
+		Size:    upd.Size,
+	}
+	if upd.Replaced {
+		newAttrs.Type = typeName(upd.NewType)
+	}
+	if upd.Mode != nil {
+		newAttrs.Type = typeName(upd.Mode.Type())
+		newAttrs.Mode = octalMode(*upd.Mode)
+	}
+
+	if oldAttrs != (EventAttrs{}) {
+		e.Old = &oldAttrs
+	}
+	if newAttrs != (EventAttrs{}) {
+		e.New = &newAttrs
+	}
+
+	return e
+}
+
+// PathUpdate returns the update of an update event.
+func (e Event) PathUpdate() (PathUpdate, error) {
+	upd := PathUpdate{
+		Path: e.Path,
+		Update: Update{
+			ContentChanged: e.ContentChanged,
+			Xattrs:         e.Xattrs,
+			Descendants:    e.Descendants,
+			FreedBytes:     e.FreedBytes,
+			Diff:           e.Diff,
+		},
+	}
+
+	switch e.Kind {
+	case EventAdded:
+		upd.Added = true
+	case EventDeleted:
+		upd.Deleted = true
+	case EventReplaced:
+		upd.Replaced = true
+	case EventUpdated:
+	default:
+		return PathUpdate{}, fmt.Errorf("not an update event: %s", e.Kind)
+	}
+
+	if e.Old != nil {
+		typ, mode, err := e.Old.mode()
+		if err != nil {
+			return PathUpdate{}, fmt.Errorf("failed to decode old attributes: %s: %w", e.Path, err)
+		}
+
+		if upd.Deleted || upd.Replaced {
+			upd.OldType = typ
+		}
+		upd.OldMode = mode
+		upd.OldUid = e.Old.Uid
+		upd.OldGid = e.Old.Gid
+		upd.OldModTime = localTime(e.Old.ModTime)
+		upd.OldLink = e.Old.Link
+		upd.OldSize = e.Old.Size
+	}
+
+	if e.New != nil {
+		typ, mode, err := e.New.mode()
+		if err != nil {
+			return PathUpdate{}, fmt.Errorf("failed to decode new attributes: %s: %w", e.Path, err)
+		}
+
+		if upd.Replaced {
+			upd.NewType = typ
+		}
+		upd.Mode = mode
+		upd.Uid = e.New.Uid
+		upd.Gid = e.New.Gid
+		upd.ModTime = localTime(e.New.ModTime)
+		upd.Link = e.New.Link
+		upd.Size = e.New.Size
+	}
+
+	return upd, nil
+}
+
+// mode returns the file type of a and its mode including the type, or nil if a has no mode.
+func (a EventAttrs) mode() (fs.FileMode, *fs.FileMode, error) {
+	var typ fs.FileMode
+	if a.Type != "" {
+		var err error
+		if typ, err = parseTypeName(a.Type); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if a.Mode == "" {
+		return typ, nil, nil
+	}
+
+	mode, err := parseOctalMode(a.Mode)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return typ, ptr(typ | mode), nil
+}
+
+// localTime returns t in local time like the modtimes of updates, or nil if t is nil.
+func localTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return ptr(t.Local())
+}
+
+// Encoder writes events to an io.Writer as NDJSON, one JSON object per line.
+type Encoder struct {
+	enc *json.Encoder
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &Encoder{enc: enc}
+}
+
+func (e *Encoder) Encode(event Event) error {
+	if err := e.enc.Encode(event); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
+
+func (e *Encoder) EncodeUpdate(upd PathUpdate) error {
+	return e.Encode(NewUpdateEvent(upd))
+}
+
+func (e *Encoder) EncodeSummary(summary Summary) error {
+	return e.Encode(Event{Version: EventVersion, Kind: EventSummary, Summary: &summary})
+}
+
+func (e *Encoder) EncodeError(err error) error {
+	return e.Encode(Event{Version: EventVersion, Kind: EventError, Error: err.Error()})
+}
+
+// Decoder reads the events written by Encoder.
+type Decoder struct {
+	dec *json.Decoder
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{dec: json.NewDecoder(r)}
+}
+
+// Decode returns the next event, or io.EOF at the end of the stream. Events of another schema
+// version are rejected.
+func (d *Decoder) Decode() (Event, error) {
+	e := Event{}
+	if err := d.dec.Decode(&e); errors.Is(err, io.EOF) {
+		return Event{}, io.EOF
+	} else if err != nil {
+		return Event{}, fmt.Errorf("failed to read event: %w", err)
+	}
+
+	if e.Version != EventVersion {
+		return Event{}, fmt.Errorf("unsupported event version: %d", e.Version)
+	}
+
+	return e, nil
+}
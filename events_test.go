@@ -0,0 +1,158 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvents(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Events", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    0777,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "delete.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		events := &bytes.Buffer{}
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithEvents(events))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		lines := strings.SplitAfter(events.String(), "\n")
+		require.Len(t, lines, 4)
+		assert.Equal(t, `{"v":1,"kind":"updated","path":"test.txt","old":{"type":"file","mode":"0644"},"new":{"type":"file","mode":"0777"}}`+"\n", lines[0])
+		assert.Equal(t, `{"v":1,"kind":"deleted","path":"delete.txt","old":{"type":"file","size":9},"freed_bytes":9}`+"\n", lines[1])
+		assert.Contains(t, lines[2], `{"v":1,"kind":"summary","summary":{"added":0,"updated":1,"deleted":1,`)
+
+		dec := aferosync.NewDecoder(events)
+		for range 3 {
+			_, err := dec.Decode()
+			require.Nil(t, err)
+		}
+		_, err = dec.Decode()
+		assert.Equal(t, io.EOF, err)
+
+		_, err = aferosync.NewDecoder(strings.NewReader(`{"v":2,"kind":"added","path":"test.txt"}`)).Decode()
+		assert.EqualError(t, err, "unsupported event version: 2")
+	})
+
+	t.Run("Events/Replay", func(t *testing.T) {
+		treeCfg := aferosynctest.TreeConfig{Symlinks: true, HardLinks: true, Ownership: true}
+
+		r := rand.New(rand.NewPCG(4, 0))
+		for range 20 {
+			err := aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			a := aferosynctest.RandomTree(r, treeCfg)
+			b := aferosynctest.MutateTree(r, a, treeCfg)
+
+			err = a.WriteFs(afs)
+			require.Nil(t, err)
+			bBts, err := b.Tar()
+			require.Nil(t, err)
+
+			// sync
+			events := &bytes.Buffer{}
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), append(opts, aferosync.WithEvents(events), aferosync.WithContentDiff(1024))...)
+			updates, err := sync.Run()
+			require.Nil(t, err)
+
+			// replay
+			replayed := []aferosync.PathUpdate{}
+			var last aferosync.Event
+			dec := aferosync.NewDecoder(events)
+			for {
+				event, err := dec.Decode()
+				if err == io.EOF {
+					break
+				}
+				require.Nil(t, err)
+
+				last = event
+				if event.Kind == aferosync.EventSummary {
+					continue
+				}
+
+				upd, err := event.PathUpdate()
+				require.Nil(t, err)
+				replayed = append(replayed, upd)
+			}
+
+			assert.Equal(t, updates, replayed)
+			require.Equal(t, aferosync.EventSummary, last.Kind)
+			assert.Positive(t, last.Summary.Duration)
+			last.Summary.Duration = 0
+			assert.Equal(t, summary(sync), *last.Summary)
+		}
+	})
+
+	t.Run("Events/Error", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		// failChtimesFs hides the optional interfaces of afs
+		ffs := &failChtimesFs{Fs: afs, fail: "test.txt"}
+		events := &bytes.Buffer{}
+		sync := aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithEvents(events), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false), aferosync.WithOwnership(false))...)
+		_, err = sync.Run()
+		require.NotNil(t, err)
+
+		// assert
+		event, err := aferosync.NewDecoder(events).Decode()
+		require.Nil(t, err)
+		assert.Equal(t, aferosync.Event{
+			Version: aferosync.EventVersion,
+			Kind:    aferosync.EventError,
+			Error:   sync.Err().Error(),
+		}, event)
+	})
+}
@@ -0,0 +1,62 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// fileHeader returns a tar header describing the file at path in fsys, including the ownership,
+// symlink target and extended attributes if fsys and fi support them.
+func fileHeader(fsys afero.Fs, path string, fi fs.FileInfo) (*tar.Header, error) {
+	var link string
+	if fi.Mode().Type() == fs.ModeSymlink {
+		symlinker, ok := fsys.(afero.Symlinker)
+		if !ok {
+			return nil, fmt.Errorf("fs doesn't implement afero.Symlinker")
+		}
+
+		var err error
+		if link, err = symlinker.ReadlinkIfPossible(path); err != nil {
+			return nil, fmt.Errorf("failed to read link: %s: %w", path, err)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make header: %s: %w", path, err)
+	}
+
+	hdr.Name = path
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+
+	if owner, ok := fi.(FileInfoOwner); ok {
+		hdr.Uid = owner.Uid()
+		hdr.Gid = owner.Gid()
+	}
+
+	if xattrer, ok := fsys.(Xattrer); ok {
+		xattrs, err := fsXattrs(xattrer, path, fi.Mode().Type() == fs.ModeSymlink)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxSchilyXattr+name] = value
+		}
+	}
+
+	return hdr, nil
+}
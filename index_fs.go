@@ -0,0 +1,224 @@
+package aferosync
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/gaboose/aferosync/memfs"
+	"github.com/spf13/afero"
+)
+
+// errContentNotIndexed is returned when reading the content of a file whose content indexFs didn't
+// keep.
+var errContentNotIndexed = errors.New("content isn't indexed")
+
+// indexFs is the fs DiffTars indexes a tar in. It's a memfs.Fs that keeps the sizes of regular
+// files instead of their content, so an index takes memory proportional to the number of entries
+// rather than their size. Content of files of at most keepSize bytes is kept for content diffs.
+type indexFs struct {
+	*memfs.Fs
+	keepSize int64
+
+	// sizes holds the sizes of the inodes whose content isn't kept
+	sizes map[int]int64
+}
+
+func newIndexFs(keepSize int64) *indexFs {
+	return &indexFs{
+		Fs:       memfs.New(),
+		keepSize: keepSize,
+		sizes:    map[int]int64{},
+	}
+}
+
+func (x *indexFs) Create(name string) (afero.File, error) {
+	return x.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (x *indexFs) Open(name string) (afero.File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *indexFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := x.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+
+	ino := fi.(*memfs.FileInfo).Ino()
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		delete(x.sizes, ino)
+	}
+
+	return &indexFile{File: f, fs: x, ino: ino, flag: flag}, nil
+}
+
+func (x *indexFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := x.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return x.fileInfo(fi), nil
+}
+
+func (x *indexFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, ok, err := x.Fs.LstatIfPossible(name)
+	if err != nil {
+		return nil, ok, err
+	}
+	return x.fileInfo(fi), ok, nil
+}
+
+// fileInfo replaces the size of fi with the recorded one if its content isn't kept.
+func (x *indexFs) fileInfo(fi os.FileInfo) os.FileInfo {
+	mfi := fi.(*memfs.FileInfo)
+	if size, ok := x.sizes[mfi.Ino()]; ok {
+		return &indexFileInfo{FileInfo: mfi, size: size}
+	}
+	return fi
+}
+
+type indexFileInfo struct {
+	*memfs.FileInfo
+	size int64
+}
+
+func (fi *indexFileInfo) Size() int64 { return fi.size }
+
+// indexFile is a regular file of indexFs. It keeps its own offset, so that writes past keepSize
+// don't have to reach the memfs file.
+type indexFile struct {
+	afero.File
+	fs   *indexFs
+	ino  int
+	flag int
+	off  int64
+}
+
+func (f *indexFile) size() (int64, error) {
+	if size, ok := f.fs.sizes[f.ino]; ok {
+		return size, nil
+	}
+
+	fi, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// discard drops the content of the file, keeping only its size.
+func (f *indexFile) discard() error {
+	if _, ok := f.fs.sizes[f.ino]; ok {
+		return nil
+	}
+
+	size, err := f.size()
+	if err != nil {
+		return err
+	}
+
+	if err := f.File.Truncate(0); err != nil {
+		return err
+	}
+	f.fs.sizes[f.ino] = size
+
+	return nil
+}
+
+func (f *indexFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *indexFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, ok := f.fs.sizes[f.ino]; ok {
+		return 0, &fs.PathError{Op: "read", Path: f.Name(), Err: errContentNotIndexed}
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *indexFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.Name(), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *indexFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		f.off = size
+	}
+
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *indexFile) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if _, ok := f.fs.sizes[f.ino]; !ok && end <= f.fs.keepSize {
+		return f.File.WriteAt(p, off)
+	}
+
+	if err := f.discard(); err != nil {
+		return 0, err
+	}
+	f.fs.sizes[f.ino] = max(f.fs.sizes[f.ino], end)
+
+	return len(p), nil
+}
+
+func (f *indexFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *indexFile) Truncate(size int64) error {
+	if _, ok := f.fs.sizes[f.ino]; !ok && size <= f.fs.keepSize {
+		return f.File.Truncate(size)
+	}
+
+	if err := f.discard(); err != nil {
+		return err
+	}
+	f.fs.sizes[f.ino] = size
+
+	return nil
+}
+
+func (f *indexFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.fs.fileInfo(fi), nil
+}
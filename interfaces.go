@@ -16,3 +16,19 @@ type FileInfoOwner interface {
 type FileInfoInoer interface {
 	Ino() int
 }
+
+type FileInfoNlinker interface {
+	Nlink() int
+}
+
+type Xattrer interface {
+	Listxattr(name string) ([]string, error)
+	Getxattr(name, attr string) ([]byte, error)
+	Setxattr(name, attr string, value []byte) error
+	Removexattr(name, attr string) error
+
+	Llistxattr(name string) ([]string, error)
+	Lgetxattr(name, attr string) ([]byte, error)
+	Lsetxattr(name, attr string, value []byte) error
+	Lremovexattr(name, attr string) error
+}
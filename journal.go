@@ -0,0 +1,302 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	journalHeader      = "aferosync-journal 2"
+	defaultJournalPath = ".aferosync-journal"
+)
+
+// journal is an append-only log of a sync's progress. It records the original modtimes of touched
+// directories, entries whose content is being written and completed entries, so that an
+// interrupted sync can be resumed by a new Sync with the same source. All records are durable, each
+// is synced to storage as soon as it's written. Deletions aren't recorded, a resumed sync finds the
+// paths left to delete by walking the fs again.
+//
+// The header holds the source ID set by WithJournalID and completed entries are recorded with the
+// digest of their tar header, so that a journal left by another source doesn't skip its entries.
+type journal struct {
+	fs   afero.Fs
+	path string
+	f    afero.File
+
+	dirModTimes map[string]time.Time
+	begun       map[string]struct{}
+
+	// done maps the paths of completed entries to the digests of their headers
+	done map[string]string
+}
+
+// openJournal loads the records of an existing journal at path and opens it for appending. A
+// journal of another source ID or format version is discarded.
+func openJournal(fsys afero.Fs, path string, id string) (*journal, error) {
+	j := journal{
+		fs:          fsys,
+		path:        path,
+		dirModTimes: map[string]time.Time{},
+		begun:       map[string]struct{}{},
+		done:        map[string]string{},
+	}
+
+	bts, err := afero.ReadFile(fsys, path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read journal: %s: %w", path, err)
+	}
+
+	header := journalHeader + " " + strconv.Quote(id) + "\n"
+	if !bytes.HasPrefix(bts, []byte(header)) {
+		bts = nil
+	}
+
+	if len(bts) > 0 {
+		if err := j.load(bytes.NewReader(bts[len(header):])); err != nil {
+			return nil, fmt.Errorf("failed to load journal: %s: %w", path, err)
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if len(bts) == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	j.f, err = fsys.OpenFile(path, flag, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %s: %w", path, err)
+	}
+
+	if len(bts) == 0 {
+		if _, err := io.WriteString(j.f, header); err != nil {
+			j.f.Close()
+			return nil, fmt.Errorf("failed to write journal: %s: %w", path, err)
+		}
+	} else if bts[len(bts)-1] != '\n' {
+		// terminate a record torn by the interruption
+		if _, err := io.WriteString(j.f, "\n"); err != nil {
+			j.f.Close()
+			return nil, fmt.Errorf("failed to write journal: %s: %w", path, err)
+		}
+	}
+
+	return &j, nil
+}
+
+// load reads the records that follow the header.
+func (j *journal) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kind, rest, _ := strings.Cut(scanner.Text(), " ")
+
+		var modTime time.Time
+		var digest string
+		switch kind {
+		case "dir":
+			var nanos string
+			nanos, rest, _ = strings.Cut(rest, " ")
+			n, err := strconv.ParseInt(nanos, 10, 64)
+			if err != nil {
+				continue // torn record
+			}
+			modTime = time.Unix(0, n)
+		case "done":
+			digest, rest, _ = strings.Cut(rest, " ")
+		}
+
+		path, err := strconv.Unquote(rest)
+		if err != nil {
+			continue // torn record
+		}
+
+		switch kind {
+		case "dir":
+			if _, ok := j.dirModTimes[path]; !ok {
+				j.dirModTimes[path] = modTime
+			}
+		case "begin":
+			delete(j.done, path)
+			j.begun[path] = struct{}{}
+		case "done":
+			// a done entry is fully written, even if its header doesn't match the resumed tar
+			delete(j.begun, path)
+			j.done[path] = digest
+		}
+	}
+
+	return scanner.Err()
+}
+
+// record appends a record to the journal and syncs it to storage. The fields precede the path.
+func (j *journal) record(kind string, path string, fields ...string) error {
+	line := kind
+	for _, field := range fields {
+		line += " " + field
+	}
+
+	if _, err := fmt.Fprintf(j.f, "%s %s\n", line, strconv.Quote(path)); err != nil {
+		return fmt.Errorf("failed to write journal: %s: %w", j.path, err)
+	}
+
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %s: %w", j.path, err)
+	}
+
+	return nil
+}
+
+func (j *journal) recordDir(path string, modTime time.Time) error {
+	return j.record("dir", path, strconv.FormatInt(modTime.UnixNano(), 10))
+}
+
+// recordDone records that hdr's entry has been synced.
+func (j *journal) recordDone(hdr *tar.Header) error {
+	return j.record("done", normalizePath(hdr.Name), headerDigest(hdr))
+}
+
+// headerDigest identifies a tar entry by the fields of its header that a sync applies.
+func headerDigest(hdr *tar.Header) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%c %q %q %d %o %d %d %d\n", hdr.Typeflag, hdr.Name, hdr.Linkname, hdr.Size, hdr.Mode, hdr.Uid, hdr.Gid, hdr.ModTime.UnixNano())
+	for _, k := range slices.Sorted(maps.Keys(hdr.PAXRecords)) {
+		fmt.Fprintf(h, "%q %q\n", k, hdr.PAXRecords[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// openJournal opens the sync's journal and restores the state of an interrupted sync from it.
+func (s *Sync) openJournal() error {
+	fsys, path := s.opts.journalFs, s.opts.journalPath
+	inDest := fsys == nil
+	if inDest {
+		fsys = s.fs
+		path = normalizePath(path)
+		delete(s.pathMap, path)
+
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	j, err := openJournal(fsys, path, s.opts.journalID)
+	if err != nil {
+		return err
+	}
+	s.journal = j
+
+	// directory modtimes recorded before the interruption are the original ones
+	if s.dirModTimes == nil {
+		s.dirModTimes = map[string]time.Time{}
+	}
+	for dir, modTime := range j.dirModTimes {
+		s.dirModTimes[dir] = modTime
+	}
+
+	for dir, modTime := range s.dirModTimes {
+		if _, ok := j.dirModTimes[dir]; ok {
+			continue
+		}
+
+		if err := j.recordDir(dir, modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// journalBegin records that path's content is about to be written.
+func (s *Sync) journalBegin(path string) error {
+	if s.journal == nil {
+		return nil
+	}
+
+	return s.journal.record("begin", path)
+}
+
+// resumeEntry returns true if the journal records hdr's entry as completed with the same header.
+// Files that were being written when the previous sync was interrupted are removed so that they're
+// written again.
+func (s *Sync) resumeEntry(hdr *tar.Header) (bool, error) {
+	if s.journal == nil {
+		return false, nil
+	}
+
+	path := normalizePath(hdr.Name)
+	if digest, ok := s.journal.done[path]; ok && digest == headerDigest(hdr) {
+		if s.opts.withDeferredDirs && hdr.Typeflag == tar.TypeDir {
+			s.deferredDirs = append(s.deferredDirs, deferredDir{
+				path:    path,
+				mode:    hdr.FileInfo().Mode(),
+				modTime: hdr.ModTime,
+			})
+		}
+		return true, nil
+	}
+
+	if _, ok := s.journal.begun[path]; ok {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
+			return false, err
+		}
+
+		if err := s.fs.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("failed to remove half-written file: %s: %w", path, err)
+		}
+	}
+
+	return false, nil
+}
+
+// closeJournal removes the journal of a completed sync, preserving the modtime of its directory.
+func (s *Sync) closeJournal() error {
+	if s.journal == nil {
+		return nil
+	}
+
+	j := s.journal
+	s.journal = nil
+
+	if err := j.close(); err != nil {
+		return fmt.Errorf("failed to close journal: %s: %w", j.path, err)
+	}
+
+	if s.opts.journalFs != nil {
+		return j.fs.Remove(j.path)
+	}
+
+	dir := filepath.Dir(j.path)
+	fi, _, err := LstatOrStat(s.fs, dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", dir, err)
+	}
+
+	if err := s.fs.Remove(j.path); err != nil {
+		return fmt.Errorf("failed to remove journal: %s: %w", j.path, err)
+	}
+
+	if err := s.fs.Chtimes(dir, fi.ModTime(), fi.ModTime()); err != nil {
+		return fmt.Errorf("failed to preserve base dir modtime: %s: %w", dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testJournal(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Journal", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		files := []struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./dir/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}}
+		for _, name := range []string{"a", "b", "c"} {
+			files = append(files, struct {
+				Header tar.Header
+				Body   string
+			}{
+				Header: tar.Header{
+					Name:    "./dir/" + name,
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			})
+		}
+		bts, err := aferosynctest.NewTar(files)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chmod("dir", fs.ModeDir|fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "dir/todelete", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("dir", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// interrupted sync
+		// failChtimesFs hides the optional interfaces of afs
+		ffs := &failChtimesFs{Fs: afs, fail: "dir/b"}
+		sync := aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))...)
+		_, err = sync.Run()
+		require.NotNil(t, err)
+
+		_, err = afs.Stat(".aferosync-journal")
+		require.Nil(t, err)
+
+		// resumed sync
+		var updates []aferosync.PathUpdate
+		sync = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		var paths []string
+		for _, upd := range updates {
+			paths = append(paths, upd.Path)
+		}
+		assert.Equal(t, []string{"dir/b", "dir/c", "dir/todelete"}, paths)
+
+		dirFileInfo, err := afs.Stat("dir")
+		require.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), dirFileInfo.ModTime().Local())
+
+		_, err = afs.Stat(".aferosync-journal")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		aferosynctest.AssertEqualTars(t, bts, afs)
+	})
+	t.Run("Journal/Delete", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./dir/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./dir/keep",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chmod("dir", fs.ModeDir|fs.ModePerm)
+		require.Nil(t, err)
+		for _, name := range []string{"dir/keep", "dir/todelete1", "dir/todelete2"} {
+			err = afero.WriteFile(afs, name, []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes(name, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+		err = afs.Chtimes("dir", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync interrupted after the first deletion
+		// failRemoveAllFs hides the optional interfaces of afs
+		ffs := &failRemoveAllFs{Fs: afs, fail: "dir/todelete2"}
+		sync := aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))...)
+		updates, err := sync.Run()
+		require.NotNil(t, err)
+		require.Len(t, updates, 1)
+		assert.Equal(t, "dir/todelete1", updates[0].Path)
+
+		_, err = afs.Stat(".aferosync-journal")
+		require.Nil(t, err)
+
+		// resumed sync
+		updates, err = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""))...).Run()
+		require.Nil(t, err)
+
+		// assert
+		require.Len(t, updates, 1)
+		assert.Equal(t, "dir/todelete2", updates[0].Path)
+		assert.True(t, updates[0].Deleted)
+
+		dirFileInfo, err := afs.Stat("dir")
+		require.Nil(t, err)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Local(), dirFileInfo.ModTime().Local())
+
+		_, err = afs.Stat(".aferosync-journal")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		aferosynctest.AssertEqualTars(t, bts, afs)
+	})
+
+	// newTar returns a tar of dir/a, dir/b and dir/c, where dir/a has the given body and modtime
+	newTar := func(body string, modTime time.Time) []byte {
+		files := []struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./dir/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}}
+		for _, name := range []string{"a", "b", "c"} {
+			file := struct {
+				Header tar.Header
+				Body   string
+			}{
+				Header: tar.Header{
+					Name:    "./dir/" + name,
+					Mode:    int64(fs.ModePerm),
+					ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Body: "some text",
+			}
+			if name == "a" {
+				file.Header.ModTime = modTime
+				file.Body = body
+			}
+			files = append(files, file)
+		}
+
+		bts, err := aferosynctest.NewTar(files)
+		require.Nil(t, err)
+		return bts
+	}
+
+	t.Run("Journal/OtherTar", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tars
+		bts1 := newTar("some text", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		bts2 := newTar("some other text", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+
+		// interrupted sync
+		// failChtimesFs hides the optional interfaces of afs
+		ffs := &failChtimesFs{Fs: afs, fail: "dir/b"}
+		_, err = aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts1)), append(opts, aferosync.WithJournal(""), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))...).Run()
+		require.NotNil(t, err)
+
+		// sync of another tar, dir/a is done but its header differs
+		updates, err := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts2)), append(opts, aferosync.WithJournal(""))...).Run()
+		require.Nil(t, err)
+
+		// assert
+		i := slices.IndexFunc(updates, func(upd aferosync.PathUpdate) bool { return upd.Path == "dir/a" })
+		require.NotEqual(t, -1, i)
+		assert.True(t, updates[i].ContentChanged)
+
+		aferosynctest.AssertEqualTars(t, bts2, afs)
+	})
+
+	t.Run("Journal/OtherID", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts := newTar("some text", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		// build disk
+		err = afs.Mkdir("dir", fs.ModePerm)
+		require.Nil(t, err)
+
+		// interrupted sync
+		// failChtimesFs hides the optional interfaces of afs
+		ffs := &failChtimesFs{Fs: afs, fail: "dir/b"}
+		_, err = aferosync.New(ffs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""), aferosync.WithJournalID("1"), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false))...).Run()
+		require.NotNil(t, err)
+
+		// dir/a is done in the journal but changed since
+		err = afero.WriteFile(afs, "dir/a", []byte("some other text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync with another ID
+		updates, err := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithJournal(""), aferosync.WithJournalID("2"))...).Run()
+		require.Nil(t, err)
+
+		// assert
+		i := slices.IndexFunc(updates, func(upd aferosync.PathUpdate) bool { return upd.Path == "dir/a" })
+		require.NotEqual(t, -1, i)
+		assert.True(t, updates[i].ContentChanged)
+
+		aferosynctest.AssertEqualTars(t, bts, afs)
+	})
+}
+
+// failRemoveAllFs fails to remove a single path.
+type failRemoveAllFs struct {
+	afero.Fs
+	fail string
+}
+
+func (f *failRemoveAllFs) RemoveAll(name string) error {
+	if filepath.Clean(name) == f.fail {
+		return fmt.Errorf("failed to remove: %s", name)
+	}
+	return f.Fs.RemoveAll(name)
+}
@@ -0,0 +1,51 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Layer writes the staged changes to w as an OCI style layer without committing them: whiteouts
+// (.wh.<name>) for the deleted base paths first, then the staged entries in lexical order. Staged
+// entries include the directories copied up to hold changed children. Syncing the layer with
+// WithAdditive(true) onto base applies the changes.
+func (s *Stage) Layer(w io.Writer) error {
+	whiteouts := make([]string, 0, len(s.whiteouts))
+	for path := range s.whiteouts {
+		// deleting an ancestor deletes path too
+		if s.hidden(filepath.Dir(path)) {
+			continue
+		}
+		whiteouts = append(whiteouts, path)
+	}
+	sort.Strings(whiteouts)
+
+	tw := tar.NewWriter(w)
+
+	for _, path := range whiteouts {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "./" + filepath.ToSlash(whiteoutPath(path)),
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write header: %s: %w", hdr.Name, err)
+		}
+	}
+
+	if err := writeTree(tw, s.upper, ".", tarOptions{withoutRoot: !s.rootCopied}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package memfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+)
+
+type file struct {
+	fs     *Fs
+	name   string
+	node   *inode
+	flag   int
+	off    int64
+	closed bool
+
+	// remaining directory entries for Readdir
+	dirNames []string
+	dirRead  bool
+}
+
+func (f *file) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if (write && !writable) || (!write && !readable) {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+
+	if f.node.mode.IsDir() && op != "readdir" {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	if !f.node.mode.IsDir() && op == "readdir" {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.fs.mu.Lock()
+		f.off = int64(len(f.node.data))
+		f.fs.mu.Unlock()
+	}
+
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+
+	return len(p), nil
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+
+	return nil
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	return newFileInfo(f.name, f.node), nil
+}
+
+func (f *file) Sync() error {
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *file) Readdirnames(n int) ([]string, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("readdir", false); err != nil {
+		return nil, err
+	}
+
+	if !f.dirRead {
+		for name := range f.node.entries {
+			f.dirNames = append(f.dirNames, name)
+		}
+		sort.Strings(f.dirNames)
+		f.dirRead = true
+	}
+
+	if n <= 0 {
+		names := f.dirNames
+		f.dirNames = nil
+		return names, nil
+	}
+
+	if len(f.dirNames) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(f.dirNames))
+	names := f.dirNames[:n]
+	f.dirNames = f.dirNames[n:]
+	return names, nil
+}
+
+func (f *file) Readdir(n int) ([]os.FileInfo, error) {
+	names, err := f.Readdirnames(n)
+	if err != nil {
+		return nil, err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		// entries removed since the first Readdir call are skipped
+		if node, ok := f.node.entries[name]; ok {
+			infos = append(infos, newFileInfo(path.Join(f.name, name), node))
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,50 @@
+package memfs
+
+import (
+	"io/fs"
+	"path"
+	"time"
+)
+
+// FileInfo is a snapshot of an inode. It implements aferosync.FileInfoOwner,
+// aferosync.FileInfoInoer and aferosync.FileInfoNlinker. Modtimes are in local time like
+// os.FileInfo's.
+type FileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	uid     int
+	gid     int
+	ino     int
+	nlink   int
+}
+
+func newFileInfo(name string, node *inode) *FileInfo {
+	size := int64(len(node.data))
+	if node.mode.Type() == fs.ModeSymlink {
+		size = int64(len(node.target))
+	}
+
+	return &FileInfo{
+		name:    path.Base(clean(name)),
+		size:    size,
+		mode:    node.mode,
+		modTime: node.modTime.Local(),
+		uid:     node.uid,
+		gid:     node.gid,
+		ino:     node.ino,
+		nlink:   node.nlink,
+	}
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.size }
+func (fi *FileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *FileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *FileInfo) Sys() any           { return nil }
+func (fi *FileInfo) Uid() int           { return fi.uid }
+func (fi *FileInfo) Gid() int           { return fi.gid }
+func (fi *FileInfo) Ino() int           { return fi.ino }
+func (fi *FileInfo) Nlink() int         { return fi.nlink }
@@ -0,0 +1,606 @@
+// Package memfs implements an in-memory afero.Fs with POSIX semantics: inode numbers, link counts,
+// ownership, symlinks, hard links, extended attributes and nanosecond modtimes. It implements all
+// aferosync optional interfaces, so the whole aferosync test suite can run against it without
+// libguestfs. Permissions aren't enforced, as if every caller was root.
+package memfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const maxSymlinks = 40
+
+// Fs is an in-memory filesystem. The zero value isn't usable, use New.
+type Fs struct {
+	mu      sync.Mutex
+	root    *inode
+	lastIno int
+}
+
+type inode struct {
+	ino     int
+	mode    fs.FileMode
+	uid     int
+	gid     int
+	nlink   int
+	modTime time.Time
+	data    []byte
+	target  string
+	entries map[string]*inode
+	xattrs  map[string][]byte
+}
+
+var (
+	_ afero.Fs        = (*Fs)(nil)
+	_ afero.Lstater   = (*Fs)(nil)
+	_ afero.Symlinker = (*Fs)(nil)
+)
+
+// New returns an empty filesystem with a 0755 root directory.
+func New() *Fs {
+	m := &Fs{}
+	m.root = m.newInode(fs.ModeDir | 0755)
+	m.root.nlink = 2
+	return m
+}
+
+func (m *Fs) newInode(mode fs.FileMode) *inode {
+	m.lastIno++
+	node := &inode{
+		ino:     m.lastIno,
+		mode:    mode,
+		nlink:   1,
+		modTime: time.Now(),
+	}
+	if mode.IsDir() {
+		node.entries = map[string]*inode{}
+		node.nlink = 2
+	}
+	return node
+}
+
+// clean turns name into a path relative to the root, "" being the root itself.
+func clean(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+func split(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// resolve looks up name and returns its parent directory, base name and inode, which is nil if
+// name doesn't exist. Symlinks are followed in the parent path and, if follow is set, in the base.
+func (m *Fs) resolve(op, name string, follow bool) (*inode, string, *inode, error) {
+	p := clean(name)
+
+	for hops := 0; hops <= maxSymlinks; hops++ {
+		parts := split(p)
+		if len(parts) == 0 {
+			return nil, "", m.root, nil
+		}
+
+		dir := m.root
+		restarted := false
+		for i, part := range parts {
+			if !dir.mode.IsDir() {
+				return nil, "", nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+			}
+
+			child := dir.entries[part]
+			last := i == len(parts)-1
+			if child == nil {
+				if last {
+					return dir, part, nil, nil
+				}
+				return nil, "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+
+			if child.mode.Type() == fs.ModeSymlink && (!last || follow) {
+				target := child.target
+				if !strings.HasPrefix(target, "/") {
+					target = path.Join(strings.Join(parts[:i], "/"), target)
+				}
+				p = clean(path.Join(append([]string{target}, parts[i+1:]...)...))
+				restarted = true
+				break
+			}
+
+			if last {
+				return dir, part, child, nil
+			}
+			dir = child
+		}
+
+		if !restarted {
+			break
+		}
+	}
+
+	return nil, "", nil, &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+}
+
+// lookup is like resolve but fails if name doesn't exist.
+func (m *Fs) lookup(op, name string, follow bool) (*inode, error) {
+	_, _, node, err := m.resolve(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return node, nil
+}
+
+// link adds node to dir as base.
+func (m *Fs) link(dir *inode, base string, node *inode) {
+	dir.entries[base] = node
+	dir.modTime = time.Now()
+	if node.mode.IsDir() {
+		dir.nlink++
+	}
+}
+
+// unlink removes base from dir.
+func (m *Fs) unlink(dir *inode, base string) {
+	node := dir.entries[base]
+	delete(dir.entries, base)
+	dir.modTime = time.Now()
+	if node.mode.IsDir() {
+		dir.nlink--
+		node.nlink = 0
+	} else {
+		node.nlink--
+	}
+}
+
+func (m *Fs) Name() string {
+	return "memfs"
+}
+
+func (m *Fs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *Fs) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.resolve("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	if node != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	m.link(dir, base, m.newInode(fs.ModeDir|perm&chmodBits))
+	return nil
+}
+
+func (m *Fs) MkdirAll(name string, perm os.FileMode) error {
+	parts := split(clean(name))
+	for i := range parts {
+		err := m.Mkdir(strings.Join(parts[:i+1], "/"), perm)
+		if err == nil || !os.IsExist(err) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		fi, err := m.Stat(strings.Join(parts[:i+1], "/"))
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+	return nil
+}
+
+func (m *Fs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if node == nil {
+		if flag&os.O_CREATE == 0 || dir == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		node = m.newInode(perm & chmodBits)
+		m.link(dir, base, node)
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.mode.IsDir() && writable {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	if flag&os.O_TRUNC != 0 && writable && len(node.data) > 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &file{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+func (m *Fs) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if dir == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if node.mode.IsDir() && len(node.entries) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	m.unlink(dir, base)
+	return nil
+}
+
+func (m *Fs) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.resolve("removeall", name, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return nil
+	}
+
+	// removing the root removes its children
+	if dir == nil {
+		for base := range node.entries {
+			m.unlinkAll(node, base)
+		}
+		return nil
+	}
+
+	m.unlinkAll(dir, base)
+	return nil
+}
+
+func (m *Fs) unlinkAll(dir *inode, base string) {
+	node := dir.entries[base]
+	if node.mode.IsDir() {
+		for child := range node.entries {
+			m.unlinkAll(node, child)
+		}
+	}
+	m.unlink(dir, base)
+}
+
+func (m *Fs) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldDir, oldBase, node, err := m.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+
+	newDir, newBase, existing, err := m.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	if oldDir == nil || newDir == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EBUSY}
+	}
+	if existing == node {
+		return nil
+	}
+
+	// a directory can't be moved into itself
+	if node.mode.IsDir() {
+		for p := clean(newname); p != ""; p = parentPath(p) {
+			if n, _ := m.lookup("rename", p, false); n == node {
+				return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+			}
+		}
+	}
+
+	if existing != nil {
+		switch {
+		case existing.mode.IsDir() && !node.mode.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+		case !existing.mode.IsDir() && node.mode.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+		case existing.mode.IsDir() && len(existing.entries) > 0:
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+		}
+		m.unlink(newDir, newBase)
+	}
+
+	m.unlink(oldDir, oldBase)
+	if node.mode.IsDir() {
+		node.nlink = 2
+		for _, child := range node.entries {
+			if child.mode.IsDir() {
+				node.nlink++
+			}
+		}
+	} else {
+		node.nlink++
+	}
+	m.link(newDir, newBase, node)
+	return nil
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+func (m *Fs) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(name, node), nil
+}
+
+func (m *Fs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("lstat", name, false)
+	if err != nil {
+		return nil, true, err
+	}
+	return newFileInfo(name, node), true, nil
+}
+
+const chmodBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+func (m *Fs) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode.Type() | mode&chmodBits
+	return nil
+}
+
+func (m *Fs) Chown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+	chown(node, uid, gid)
+	return nil
+}
+
+// Lchown is like Chown but doesn't follow symlinks.
+func (m *Fs) Lchown(name string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("lchown", name, false)
+	if err != nil {
+		return err
+	}
+	chown(node, uid, gid)
+	return nil
+}
+
+// chown changes the owner of node, clearing the setuid and setgid bits of executables like Linux.
+func chown(node *inode, uid, gid int) {
+	if uid != -1 {
+		node.uid = uid
+	}
+	if gid != -1 {
+		node.gid = gid
+	}
+
+	if node.mode.IsRegular() {
+		node.mode &^= fs.ModeSetuid
+		if node.mode&0010 != 0 {
+			node.mode &^= fs.ModeSetgid
+		}
+	}
+}
+
+// Chtimes sets the modtime of name. Like in afero-guestfs, symlinks themselves are changed rather
+// than their targets.
+func (m *Fs) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("chtimes", name, false)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (m *Fs) SymlinkIfPossible(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.resolve("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	if node != nil || dir == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	link := m.newInode(fs.ModeSymlink | fs.ModePerm)
+	link.target = oldname
+	m.link(dir, base, link)
+	return nil
+}
+
+func (m *Fs) ReadlinkIfPossible(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode.Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return node.target, nil
+}
+
+// Link creates newname as a hard link to oldname.
+func (m *Fs) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	dir, base, existing, err := m.resolve("link", newname, false)
+	if err != nil {
+		return err
+	}
+	if existing != nil || dir == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	node.nlink++
+	m.link(dir, base, node)
+	return nil
+}
+
+func (m *Fs) Listxattr(name string) ([]string, error) { return m.listxattr(name, true) }
+
+func (m *Fs) Llistxattr(name string) ([]string, error) { return m.listxattr(name, false) }
+
+func (m *Fs) listxattr(name string, follow bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("listxattr", name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(node.xattrs))
+	for attr := range node.xattrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *Fs) Getxattr(name, attr string) ([]byte, error) { return m.getxattr(name, attr, true) }
+
+func (m *Fs) Lgetxattr(name, attr string) ([]byte, error) { return m.getxattr(name, attr, false) }
+
+func (m *Fs) getxattr(name, attr string, follow bool) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("getxattr", name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := node.xattrs[attr]
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: syscall.ENODATA}
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (m *Fs) Setxattr(name, attr string, value []byte) error {
+	return m.setxattr(name, attr, value, true)
+}
+
+func (m *Fs) Lsetxattr(name, attr string, value []byte) error {
+	return m.setxattr(name, attr, value, false)
+}
+
+func (m *Fs) setxattr(name, attr string, value []byte, follow bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("setxattr", name, follow)
+	if err != nil {
+		return err
+	}
+
+	if node.xattrs == nil {
+		node.xattrs = map[string][]byte{}
+	}
+	node.xattrs[attr] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *Fs) Removexattr(name, attr string) error { return m.removexattr(name, attr, true) }
+
+func (m *Fs) Lremovexattr(name, attr string) error { return m.removexattr(name, attr, false) }
+
+func (m *Fs) removexattr(name, attr string, follow bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("removexattr", name, follow)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := node.xattrs[attr]; !ok {
+		return &fs.PathError{Op: "removexattr", Path: name, Err: syscall.ENODATA}
+	}
+	delete(node.xattrs, attr)
+	return nil
+}
@@ -0,0 +1,27 @@
+package memfs_test
+
+import (
+	"testing"
+
+	"github.com/gaboose/aferosync/memfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackslashName(t *testing.T) {
+	afs := memfs.New()
+
+	// backslashes are ordinary characters in POSIX names, not separators
+	err := afero.WriteFile(afs, `a\b`, []byte("some text"), 0644)
+	require.Nil(t, err)
+
+	fis, err := afero.ReadDir(afs, ".")
+	require.Nil(t, err)
+	require.Len(t, fis, 1)
+	assert.Equal(t, `a\b`, fis[0].Name())
+	assert.False(t, fis[0].IsDir())
+
+	_, err = afs.Stat("a")
+	assert.NotNil(t, err)
+}
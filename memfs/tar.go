@@ -0,0 +1,98 @@
+package memfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"syscall"
+)
+
+const paxSchilyXattr = "SCHILY.xattr."
+
+// TarOut writes the tree at dir to w as a PAX tar archive with names relative to dir. Hard links
+// are written as links to the first path of their inode in lexical order and extended attributes
+// as SCHILY.xattr records.
+func (m *Fs) TarOut(dir string, w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, err := m.lookup("tarout", dir, true)
+	if err != nil {
+		return err
+	}
+	if !node.mode.IsDir() {
+		return &fs.PathError{Op: "tarout", Path: dir, Err: syscall.ENOTDIR}
+	}
+
+	tw := tar.NewWriter(w)
+	if err := m.tarOut(tw, ".", node, map[*inode]string{}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (m *Fs) tarOut(tw *tar.Writer, name string, node *inode, leaders map[*inode]string) error {
+	hdr, err := tar.FileInfoHeader(newFileInfo(name, node), node.target)
+	if err != nil {
+		return fmt.Errorf("failed to make header: %s: %w", name, err)
+	}
+
+	hdr.Name = "./" + name
+	if name == "." {
+		hdr.Name = "./"
+	} else if node.mode.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid = node.uid
+	hdr.Gid = node.gid
+	hdr.Format = tar.FormatPAX
+
+	for attr, value := range node.xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxSchilyXattr+attr] = string(value)
+	}
+
+	if node.mode.IsRegular() && node.nlink > 1 {
+		if leader, ok := leaders[node]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = leader
+			hdr.Size = 0
+		} else {
+			leaders[node] = hdr.Name
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write header: %s: %w", name, err)
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := io.Copy(tw, bytes.NewReader(node.data)); err != nil {
+			return fmt.Errorf("failed to write file: %s: %w", name, err)
+		}
+	}
+
+	if !node.mode.IsDir() {
+		return nil
+	}
+
+	names := make([]string, 0, len(node.entries))
+	for child := range node.entries {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+
+	for _, child := range names {
+		if err := m.tarOut(tw, path.Join(name, child), node.entries[child], leaders); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,9 +1,41 @@
 package aferosync
 
+import (
+	"io"
+
+	"github.com/spf13/afero"
+)
+
 type options struct {
 	withSymlinks  bool
 	withHardLinks bool
 	withOwnership bool
+	withXattrs    bool
+	withSparse    bool
+	withAtomic    bool
+
+	withDeferredDirs bool
+
+	withAdditive bool
+	undoWriter   io.Writer
+
+	withJournal bool
+	journalFs   afero.Fs
+	journalPath string
+	journalID   string
+
+	withSELinux bool
+	selinuxFs   afero.Fs
+	selinuxPath string
+
+	withDryRun  bool
+	layerWriter io.Writer
+
+	contentDiffMaxSize int64
+
+	withDeleteRollup bool
+
+	eventWriter io.Writer
 }
 
 type Option func(opts *options)
@@ -12,6 +44,10 @@ var defaultOpts = []Option{
 	WithSymlinks(true),
 	WithHardLinks(true),
 	WithOwnership(true),
+	WithXattrs(false),
+	WithSparse(false),
+	WithAtomicWrites(false),
+	WithDeferredDirs(false),
 }
 
 func WithSymlinks(v bool) Option {
@@ -31,3 +67,157 @@ func WithOwnership(v bool) Option {
 		opts.withOwnership = v
 	}
 }
+
+// WithXattrs enables syncing extended attributes from SCHILY.xattr PAX records. This includes
+// file capabilities (security.capability) and POSIX ACLs (system.posix_acl_*). It requires fs to
+// implement aferosync.Xattrer.
+func WithXattrs(v bool) Option {
+	return func(opts *options) {
+		opts.withXattrs = v
+	}
+}
+
+// WithSparse writes regular files sparsely, leaving holes where the tar has sparse regions or
+// blocks of zeros. Holes are punched with aferosync.PunchHoler if the fs's files implement it.
+func WithSparse(v bool) Option {
+	return func(opts *options) {
+		opts.withSparse = v
+	}
+}
+
+// WithAtomicWrites writes new file content to a sibling temp file, applies its metadata and renames
+// it over the target, so that an interrupted sync never leaves a half-written file behind. Temp
+// files left behind by interrupted syncs are removed regardless of this option.
+func WithAtomicWrites(v bool) Option {
+	return func(opts *options) {
+		opts.withAtomic = v
+	}
+}
+
+// WithDeferredDirs creates directories writable by their owner and applies their final mode and
+// modtime deepest-first after all entries have been processed, like GNU tar's delayed set-stat.
+// This allows syncing read-only directories into filesystems that enforce permissions.
+func WithDeferredDirs(v bool) Option {
+	return func(opts *options) {
+		opts.withDeferredDirs = v
+	}
+}
+
+// WithAdditive keeps paths that are missing from the tar instead of deleting them. Instead, OCI
+// style whiteout entries (.wh.<name>) delete the paths they name.
+func WithAdditive(v bool) Option {
+	return func(opts *options) {
+		opts.withAdditive = v
+	}
+}
+
+// WithUndo writes the content and metadata of everything the sync overwrites or deletes to w as a
+// tar, followed by whiteouts for the paths it adds. Syncing the undo archive with
+// WithAdditive(true) rolls the sync back.
+func WithUndo(w io.Writer) Option {
+	return func(opts *options) {
+		opts.undoWriter = w
+	}
+}
+
+// WithJournal records the progress of the sync in a journal at path in the destination fs, or at
+// .aferosync-journal if path is empty. If a sync is interrupted, a new Sync with the same source and
+// journal skips completed entries, rewrites half-written files and restores the original modtimes
+// of touched directories. The journal is removed once the sync completes.
+//
+// Entries are only skipped if their tar headers match the recorded ones, and a journal whose source
+// ID doesn't match the one set by WithJournalID is discarded. Pending deletions aren't recorded:
+// the resumed sync reads the whole tar again, so it finds the paths left to delete by walking the
+// destination the same way the interrupted one did.
+func WithJournal(path string) Option {
+	return func(opts *options) {
+		if path == "" {
+			path = defaultJournalPath
+		}
+
+		opts.withJournal = true
+		opts.journalFs = nil
+		opts.journalPath = path
+	}
+}
+
+// WithJournalFs is like WithJournal but stores the journal at path in fsys.
+func WithJournalFs(fsys afero.Fs, path string) Option {
+	return func(opts *options) {
+		opts.withJournal = true
+		opts.journalFs = fsys
+		opts.journalPath = path
+	}
+}
+
+// WithJournalID identifies the source of the sync in its journal, e.g. with a digest or a
+// reference of the tar. A journal left by a sync with another ID is discarded rather than resumed.
+func WithJournalID(id string) Option {
+	return func(opts *options) {
+		opts.journalID = id
+	}
+}
+
+// WithSELinux sets security.selinux labels of synced paths from the file_contexts file at path in
+// the destination fs. If path is empty, the file_contexts of the policy configured in
+// etc/selinux/config is used. Labels are set through aferosync.Xattrer.
+func WithSELinux(path string) Option {
+	return func(opts *options) {
+		opts.withSELinux = true
+		opts.selinuxFs = nil
+		opts.selinuxPath = path
+	}
+}
+
+// WithSELinuxFileContexts is like WithSELinux but loads the file_contexts file from fsys.
+func WithSELinuxFileContexts(fsys afero.Fs, path string) Option {
+	return func(opts *options) {
+		opts.withSELinux = true
+		opts.selinuxFs = fsys
+		opts.selinuxPath = path
+	}
+}
+
+// WithDryRun runs the sync against a Stage on top of the destination fs, which is only read from.
+// The updates are reported as usual but never committed.
+func WithDryRun(v bool) Option {
+	return func(opts *options) {
+		opts.withDryRun = v
+	}
+}
+
+// WithLayer runs the sync as a dry run and writes its changes to w as an OCI style layer once it
+// completes: whiteouts (.wh.<name>) for the deleted paths followed by the added and changed
+// entries. Syncing the layer with WithAdditive(true) applies the changes.
+func WithLayer(w io.Writer) Option {
+	return func(opts *options) {
+		opts.withDryRun = true
+		opts.layerWriter = w
+	}
+}
+
+// WithContentDiff attaches a unified diff between the destination content and the tar content to
+// the updates of rewritten regular files if both are at most maxSize bytes and look like text, that
+// is valid UTF-8 without NUL bytes. The tar content of such files is buffered in memory. A maxSize of
+// 0 disables diffs.
+func WithContentDiff(maxSize int64) Option {
+	return func(opts *options) {
+		opts.contentDiffMaxSize = maxSize
+	}
+}
+
+// WithDeleteRollup reports a deleted or replaced directory with a single update that counts its
+// deleted descendants and the bytes they freed, instead of one update per descendant.
+func WithDeleteRollup(v bool) Option {
+	return func(opts *options) {
+		opts.withDeleteRollup = v
+	}
+}
+
+// WithEvents streams the updates to w as NDJSON events as the sync runs, followed by a summary
+// event once it completes or an error event if it fails. See Encoder and Decoder.
+func WithEvents(w io.Writer) Option {
+	return func(opts *options) {
+		opts.eventWriter = w
+	}
+}
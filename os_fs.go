@@ -0,0 +1,963 @@
+//go:build linux
+
+package aferosync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/spf13/afero"
+)
+
+// from linux/fcntl.h, which the syscall package doesn't export
+const (
+	oPath             = 0x200000
+	atSymlinkNofollow = 0x100
+	atRemovedir       = 0x200
+	atEmptyPath       = 0x1000
+)
+
+// maxSymlinks is the number of symlinks a read follows before failing with ELOOP, like Linux's
+// MAXSYMLINKS.
+const maxSymlinks = 40
+
+var (
+	_ afero.Symlinker = (*OsFs)(nil)
+	_ Lchowner        = (*OsFs)(nil)
+	_ Linker          = (*OsFs)(nil)
+	_ AllPathser      = (*OsFs)(nil)
+	_ Xattrer         = (*OsFs)(nil)
+
+	_ FileInfoOwner   = (*osFileInfo)(nil)
+	_ FileInfoInoer   = (*osFileInfo)(nil)
+	_ FileInfoNlinker = (*osFileInfo)(nil)
+)
+
+// OsFs is an afero.OsFs restricted to a host directory that implements all aferosync optional
+// interfaces except TarOuter. Its FileInfo implements FileInfoOwner, FileInfoInoer and
+// FileInfoNlinker.
+//
+// To behave like the other backends, files and directories are created with exactly the requested
+// permissions regardless of the umask, symlink targets are stored as given and Chtimes changes
+// symlinks rather than their targets.
+//
+// Changes never follow symlinks out of the root: the ancestors of a path are opened one by one
+// without following symlinks, so changes to paths below a symlink fail. OpenFile, Chmod, Chown and
+// the xattr methods without the L prefix fail with ELOOP on a symlink instead of following it.
+// Reads don't leave the root either: Open, Stat, LstatIfPossible and ReadlinkIfPossible resolve
+// symlinks as if the root was /, the way a chroot does.
+type OsFs struct {
+	*afero.BasePathFs
+	root string
+}
+
+// NewOsFs returns an OsFs rooted at the host directory root.
+func NewOsFs(root string) *OsFs {
+	return &OsFs{
+		BasePathFs: afero.NewBasePathFs(afero.NewOsFs(), root).(*afero.BasePathFs),
+		root:       filepath.Clean(root),
+	}
+}
+
+func (o *OsFs) Name() string {
+	return "OsFs"
+}
+
+func (o *OsFs) Create(name string) (afero.File, error) {
+	return o.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (o *OsFs) Open(name string) (afero.File, error) {
+	dirfd, base, err := o.resolveParent("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+
+	fd, err := syscall.Openat(dirfd, base, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	path, _ := o.RealPath(name)
+	return &osFile{os.NewFile(uintptr(fd), strings.TrimPrefix(path, o.root))}, nil
+}
+
+func (o *OsFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	dirfd, base, err := o.openParent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+
+	flag |= syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	mode := syscallMode(perm)
+
+	// create exclusively first to tell whether the file is new
+	created := flag&os.O_CREATE != 0
+	fd, err := syscall.Openat(dirfd, base, flag|os.O_EXCL, mode)
+	if created && flag&os.O_EXCL == 0 && err == syscall.EEXIST {
+		created = false
+		fd, err = syscall.Openat(dirfd, base, flag&^os.O_CREATE, mode)
+	} else if !created {
+		fd, err = syscall.Openat(dirfd, base, flag, mode)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	path, _ := o.RealPath(name)
+	f := os.NewFile(uintptr(fd), strings.TrimPrefix(path, o.root))
+
+	if created {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &osFile{f}, nil
+}
+
+func (o *OsFs) Mkdir(name string, perm os.FileMode) error {
+	dirfd, base, err := o.openParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	if err := syscall.Mkdirat(dirfd, base, syscallMode(perm)); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return o.Chmod(name, perm)
+}
+
+func (o *OsFs) MkdirAll(name string, perm os.FileMode) error {
+	if fi, _, err := o.LstatIfPossible(name); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	if dir := filepath.Dir(filepath.Clean(name)); dir != filepath.Clean(name) {
+		if err := o.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+	}
+
+	if err := o.Mkdir(name, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (o *OsFs) Remove(name string) error {
+	dirfd, base, err := o.openParent("remove", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	err = unlinkat(dirfd, base, 0)
+	if err == syscall.EISDIR {
+		err = unlinkat(dirfd, base, atRemovedir)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) RemoveAll(name string) error {
+	dirfd, base, err := o.openParent("removeall", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	if err := removeAllAt(dirfd, base); err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	return nil
+}
+
+// removeAllAt removes name in the directory dirfd and everything it contains without following
+// symlinks.
+func removeAllAt(dirfd int, name string) error {
+	err := unlinkat(dirfd, name, 0)
+	if err == nil || err == syscall.ENOENT {
+		return nil
+	} else if err != syscall.EISDIR {
+		return err
+	}
+
+	fd, err := syscall.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	err = readDirents(fd, func(name string, typ uint8) {
+		names = append(names, name)
+	})
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		err = removeAllAt(fd, name)
+	}
+	syscall.Close(fd)
+	if err != nil {
+		return err
+	}
+
+	if err := unlinkat(dirfd, name, atRemovedir); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+func (o *OsFs) Rename(oldname, newname string) error {
+	oldDirfd, oldBase, err := o.openParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldDirfd)
+
+	newDirfd, newBase, err := o.openParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newDirfd)
+
+	if err := syscall.Renameat(oldDirfd, oldBase, newDirfd, newBase); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) Chmod(name string, mode os.FileMode) error {
+	fd, err := o.openNoFollow("chmod", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// an O_PATH fd can't be fchmod'ed, but its /proc link resolves to the file itself
+	if err := syscall.Chmod(procFdPath(fd), syscallMode(mode)); err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) Chown(name string, uid, gid int) error {
+	fd, err := o.openNoFollow("chown", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Fchownat(fd, "", uid, gid, atEmptyPath); err != nil {
+		return &fs.PathError{Op: "chown", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) Stat(name string) (os.FileInfo, error) {
+	fi, err := o.lstatAt("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// the name of the symlink rather than its target's, like os.Stat
+	fi.name = filepath.Base(filepath.Clean(name))
+	return fi, nil
+}
+
+func (o *OsFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, err := o.lstatAt("lstat", name, false)
+	if err != nil {
+		return nil, true, err
+	}
+	return fi, true, nil
+}
+
+// lstatAt lstats name after resolving its symlinks with resolveParent.
+func (o *OsFs) lstatAt(op, name string, follow bool) (*osFileInfo, error) {
+	dirfd, base, err := o.resolveParent(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+
+	fi, err := os.Lstat(procFdPath(dirfd) + "/" + base)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errors.Unwrap(err)}
+	}
+	return newOsFileInfo(fi), nil
+}
+
+func (o *OsFs) ReadlinkIfPossible(name string) (string, error) {
+	dirfd, base, err := o.resolveParent("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+
+	target, err := os.Readlink(procFdPath(dirfd) + "/" + base)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.Unwrap(err)}
+	}
+	return target, nil
+}
+
+func (o *OsFs) Chtimes(name string, atime, mtime time.Time) error {
+	dirfd, base, err := o.openParent("chtimes", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	p, err := syscall.BytePtrFromString(base)
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: errno}
+	}
+
+	return nil
+}
+
+// SymlinkIfPossible stores oldname verbatim. afero.BasePathFs would make it an absolute host path.
+func (o *OsFs) SymlinkIfPossible(oldname, newname string) error {
+	dirfd, base, err := o.openParent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	if err := symlinkat(oldname, dirfd, base); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) Lchown(name string, uid, gid int) error {
+	dirfd, base, err := o.openParent("lchown", name)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+
+	if err := syscall.Fchownat(dirfd, base, uid, gid, atSymlinkNofollow); err != nil {
+		return &fs.PathError{Op: "lchown", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (o *OsFs) Link(oldname, newname string) error {
+	oldDirfd, oldBase, err := o.openParent("link", oldname)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldDirfd)
+
+	newDirfd, newBase, err := o.openParent("link", newname)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newDirfd)
+
+	if err := linkat(oldDirfd, oldBase, newDirfd, newBase); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// openParent opens the parent directory of name as an O_PATH fd for the *at syscalls and returns it
+// with the base name of name. The root is opened through its own parent.
+func (o *OsFs) openParent(op, name string) (int, string, error) {
+	path, err := o.RealPath(name)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	rel, err := filepath.Rel(o.root, path)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	if rel == "." {
+		fd, err := syscall.Open(filepath.Dir(o.root), oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		return fd, filepath.Base(o.root), nil
+	}
+
+	fd, err := syscall.Open(o.root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// one component at a time, so that no symlink is followed
+	dir := filepath.Dir(rel)
+	if dir != "." {
+		for _, elem := range strings.Split(dir, string(filepath.Separator)) {
+			next, err := syscall.Openat(fd, elem, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+			syscall.Close(fd)
+			if err != nil {
+				return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			fd = next
+		}
+	}
+
+	return fd, filepath.Base(rel), nil
+}
+
+// resolveParent is openParent for reads. Instead of failing, it resolves symlinks in the ancestors
+// of name, and in name itself if follow is set, as if the root was /. Absolute targets restart from
+// the root and .. stops at it, so the result is always inside the root.
+func (o *OsFs) resolveParent(op, name string, follow bool) (int, string, error) {
+	path, err := o.RealPath(name)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	rel, err := filepath.Rel(o.root, path)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	fd, err := syscall.Open(o.root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// resolved holds the components of the directory fd refers to, none of which is a symlink
+	var resolved []string
+	pending := strings.Split(rel, string(filepath.Separator))
+	links := 0
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+
+			syscall.Close(fd)
+			if fd, err = o.openResolved(resolved); err != nil {
+				return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			continue
+		}
+
+		if len(pending) == 0 && !follow {
+			return fd, elem, nil
+		}
+
+		next, err := syscall.Openat(fd, elem, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT && len(pending) == 0 {
+			// let the caller fail on the missing file
+			return fd, elem, nil
+		} else if err != nil {
+			syscall.Close(fd)
+			return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		stat := syscall.Stat_t{}
+		if err := syscall.Fstat(next, &stat); err != nil {
+			syscall.Close(next)
+			syscall.Close(fd)
+			return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		switch {
+		case stat.Mode&syscall.S_IFMT == syscall.S_IFLNK:
+			syscall.Close(next)
+
+			links++
+			if links > maxSymlinks {
+				syscall.Close(fd)
+				return -1, "", &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+
+			target, err := os.Readlink(procFdPath(fd) + "/" + elem)
+			if err != nil {
+				syscall.Close(fd)
+				return -1, "", &fs.PathError{Op: op, Path: name, Err: errors.Unwrap(err)}
+			}
+
+			if filepath.IsAbs(target) {
+				resolved = nil
+				syscall.Close(fd)
+				if fd, err = o.openResolved(resolved); err != nil {
+					return -1, "", &fs.PathError{Op: op, Path: name, Err: err}
+				}
+			}
+			pending = append(strings.Split(target, string(filepath.Separator)), pending...)
+		case len(pending) == 0:
+			syscall.Close(next)
+			return fd, elem, nil
+		case stat.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			syscall.Close(fd)
+			fd = next
+			resolved = append(resolved, elem)
+		default:
+			syscall.Close(next)
+			syscall.Close(fd)
+			return -1, "", &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+	}
+
+	// name resolved to a directory through . or .., which is opened through its own parent
+	syscall.Close(fd)
+	return o.openParent(op, filepath.Join(append([]string{"."}, resolved...)...))
+}
+
+// openResolved opens the directory of the components resolved by resolveParent as an O_PATH fd.
+func (o *OsFs) openResolved(resolved []string) (int, error) {
+	fd, err := syscall.Open(o.root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, elem := range resolved {
+		next, err := syscall.Openat(fd, elem, oPath|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+
+	return fd, nil
+}
+
+// openNoFollow opens name as an O_PATH fd. It fails with ELOOP if name is a symlink.
+func (o *OsFs) openNoFollow(op, name string) (int, error) {
+	dirfd, base, err := o.openParent(op, name)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(dirfd)
+
+	fd, err := syscall.Openat(dirfd, base, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	stat := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		syscall.Close(fd)
+		return -1, &fs.PathError{Op: op, Path: name, Err: err}
+	} else if stat.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		syscall.Close(fd)
+		return -1, &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+	}
+
+	return fd, nil
+}
+
+// procFdPath returns the /proc path of fd, which resolves to the file fd refers to.
+func procFdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+// AllPaths reads directories with getdents, using the entry types it returns instead of an lstat
+// per path.
+func (o *OsFs) AllPaths() ([]string, error) {
+	paths := []string{"."}
+	if err := o.readDirents(".", &paths); err != nil {
+		return nil, fmt.Errorf("failed to walk fs: %w", err)
+	}
+	return paths, nil
+}
+
+func (o *OsFs) readDirents(dir string, paths *[]string) error {
+	dirfd, base, err := o.openParent("open", dir)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Openat(dirfd, base, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var subdirs []string
+	var entries []string
+	var types []uint8
+	if err := readDirents(fd, func(name string, typ uint8) {
+		entries = append(entries, filepath.Join(dir, name))
+		types = append(types, typ)
+	}); err != nil {
+		return &fs.PathError{Op: "getdents", Path: dir, Err: err}
+	}
+
+	for i, path := range entries {
+		*paths = append(*paths, path)
+
+		typ := types[i]
+		if typ == syscall.DT_UNKNOWN {
+			fi, _, err := o.LstatIfPossible(path)
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				typ = syscall.DT_DIR
+			}
+		}
+
+		if typ == syscall.DT_DIR {
+			subdirs = append(subdirs, path)
+		}
+	}
+
+	for _, subdir := range subdirs {
+		if err := o.readDirents(subdir, paths); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readDirents calls fn with the name and type of each entry of the directory fd except . and ..
+func readDirents(fd int, fn func(name string, typ uint8)) error {
+	nameOffset := int(unsafe.Offsetof(syscall.Dirent{}.Name))
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := syscall.Getdents(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		} else if n <= 0 {
+			return nil
+		}
+
+		for off := 0; off < n; {
+			dirent := (*syscall.Dirent)(unsafe.Pointer(&buf[off]))
+			rec := buf[off : off+int(dirent.Reclen)]
+			off += int(dirent.Reclen)
+
+			name := rec[nameOffset:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if dirent.Ino == 0 || string(name) == "." || string(name) == ".." {
+				continue
+			}
+
+			fn(string(name), dirent.Type)
+		}
+	}
+}
+
+// xattrPath returns a /proc path of name as a C string, which doesn't follow symlinks in its
+// ancestors. Unless nofollow is set, name must not be a symlink either. The returned func closes
+// the fds the path refers to.
+func (o *OsFs) xattrPath(op, name string, nofollow bool) (*byte, func(), error) {
+	var path string
+	var fd int
+	if nofollow {
+		dirfd, base, err := o.openParent(op, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		path, fd = procFdPath(dirfd)+"/"+base, dirfd
+	} else {
+		f, err := o.openNoFollow(op, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		path, fd = procFdPath(f), f
+	}
+
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return p, func() { syscall.Close(fd) }, nil
+}
+
+func (o *OsFs) listxattr(trap uintptr, op, name string, nofollow bool) ([]string, error) {
+	p, closeFds, err := o.xattrPath(op, name, nofollow)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFds()
+
+	for {
+		size, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), 0, 0)
+		if errno != 0 {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errno}
+		} else if size == 0 {
+			return []string{}, nil
+		}
+
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), size)
+		if errno == syscall.ERANGE {
+			// the list grew in between
+			continue
+		} else if errno != 0 {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errno}
+		}
+
+		names := []string{}
+		for _, attr := range bytes.Split(buf[:n], []byte{0}) {
+			if len(attr) > 0 {
+				names = append(names, string(attr))
+			}
+		}
+		return names, nil
+	}
+}
+
+func (o *OsFs) getxattr(trap uintptr, op, name, attr string, nofollow bool) ([]byte, error) {
+	p, closeFds, err := o.xattrPath(op, name, nofollow)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFds()
+
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	for {
+		size, _, errno := syscall.Syscall6(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errno}
+		} else if size == 0 {
+			return []byte{}, nil
+		}
+
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall6(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), uintptr(unsafe.Pointer(&buf[0])), size, 0, 0)
+		if errno == syscall.ERANGE {
+			// the value grew in between
+			continue
+		} else if errno != 0 {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errno}
+		}
+
+		return buf[:n], nil
+	}
+}
+
+func (o *OsFs) setxattr(trap uintptr, op, name, attr string, value []byte, nofollow bool) error {
+	p, closeFds, err := o.xattrPath(op, name, nofollow)
+	if err != nil {
+		return err
+	}
+	defer closeFds()
+
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return &fs.PathError{Op: op, Path: name, Err: errno}
+	}
+
+	return nil
+}
+
+func (o *OsFs) removexattr(trap uintptr, op, name, attr string, nofollow bool) error {
+	p, closeFds, err := o.xattrPath(op, name, nofollow)
+	if err != nil {
+		return err
+	}
+	defer closeFds()
+
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	_, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), 0)
+	if errno != 0 {
+		return &fs.PathError{Op: op, Path: name, Err: errno}
+	}
+
+	return nil
+}
+
+func (o *OsFs) Listxattr(name string) ([]string, error) {
+	return o.listxattr(syscall.SYS_LISTXATTR, "listxattr", name, false)
+}
+
+func (o *OsFs) Getxattr(name, attr string) ([]byte, error) {
+	return o.getxattr(syscall.SYS_GETXATTR, "getxattr", name, attr, false)
+}
+
+func (o *OsFs) Setxattr(name, attr string, value []byte) error {
+	return o.setxattr(syscall.SYS_SETXATTR, "setxattr", name, attr, value, false)
+}
+
+func (o *OsFs) Removexattr(name, attr string) error {
+	return o.removexattr(syscall.SYS_REMOVEXATTR, "removexattr", name, attr, false)
+}
+
+func (o *OsFs) Llistxattr(name string) ([]string, error) {
+	return o.listxattr(syscall.SYS_LLISTXATTR, "llistxattr", name, true)
+}
+
+func (o *OsFs) Lgetxattr(name, attr string) ([]byte, error) {
+	return o.getxattr(syscall.SYS_LGETXATTR, "lgetxattr", name, attr, true)
+}
+
+func (o *OsFs) Lsetxattr(name, attr string, value []byte) error {
+	return o.setxattr(syscall.SYS_LSETXATTR, "lsetxattr", name, attr, value, true)
+}
+
+func (o *OsFs) Lremovexattr(name, attr string) error {
+	return o.removexattr(syscall.SYS_LREMOVEXATTR, "lremovexattr", name, attr, true)
+}
+
+// syscallMode converts mode to the permission and special bits of syscalls like os does.
+func syscallMode(mode fs.FileMode) (o uint32) {
+	o |= uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		o |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		o |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		o |= syscall.S_ISVTX
+	}
+	return o
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(oldDirfd int, oldname string, newDirfd int, newname string) error {
+	oldp, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(oldDirfd), uintptr(unsafe.Pointer(oldp)), uintptr(newDirfd), uintptr(unsafe.Pointer(newp)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func symlinkat(target string, dirfd int, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd), uintptr(unsafe.Pointer(p)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// osFile wraps the FileInfo returned by an afero.File in osFileInfo.
+type osFile struct {
+	afero.File
+}
+
+func (f *osFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return newOsFileInfo(fi), nil
+}
+
+func (f *osFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	for i, fi := range fis {
+		fis[i] = newOsFileInfo(fi)
+	}
+	return fis, err
+}
+
+// osFileInfo reads ownership, inode numbers and link counts from syscall.Stat_t.
+type osFileInfo struct {
+	fs.FileInfo
+	name string
+	stat *syscall.Stat_t
+}
+
+func newOsFileInfo(fi fs.FileInfo) *osFileInfo {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		stat = &syscall.Stat_t{}
+	}
+	return &osFileInfo{FileInfo: fi, name: fi.Name(), stat: stat}
+}
+
+func (fi *osFileInfo) Name() string { return fi.name }
+
+func (fi *osFileInfo) Uid() int   { return int(fi.stat.Uid) }
+func (fi *osFileInfo) Gid() int   { return int(fi.stat.Gid) }
+func (fi *osFileInfo) Ino() int   { return int(fi.stat.Ino) }
+func (fi *osFileInfo) Nlink() int { return int(fi.stat.Nlink) }
@@ -0,0 +1,211 @@
+//go:build linux
+
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOsFs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown requires root")
+	}
+
+	aferosynctest.Run(t, func() afero.Fs { return aferosync.NewOsFs(t.TempDir()) })
+	testFeatures(t, aferosync.NewOsFs(t.TempDir()))
+}
+
+func TestOsFsSymlinkTarget(t *testing.T) {
+	root := t.TempDir()
+	afs := aferosync.NewOsFs(root)
+
+	for _, target := range []string{"target.txt", "../target.txt", "/etc/hosts"} {
+		err := afs.SymlinkIfPossible(target, "link")
+		require.Nil(t, err)
+
+		hostTarget, err := os.Readlink(filepath.Join(root, "link"))
+		require.Nil(t, err)
+		assert.Equal(t, target, hostTarget)
+
+		fsTarget, err := afs.ReadlinkIfPossible("link")
+		require.Nil(t, err)
+		assert.Equal(t, target, fsTarget)
+
+		err = afs.Remove("link")
+		require.Nil(t, err)
+	}
+}
+
+func TestOsFsSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	err := os.WriteFile(filepath.Join(outside, "f"), []byte("some text"), 0644)
+	require.Nil(t, err)
+
+	t.Run("Sync", func(t *testing.T) {
+		afs := aferosync.NewOsFs(t.TempDir())
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./a",
+				Typeflag: tar.TypeSymlink,
+				Linkname: outside,
+				Mode:     0777,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./a/x",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		_, err = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), aferosync.WithOwnership(false)).Run()
+		assert.NotNil(t, err)
+
+		// assert
+		_, err = os.Lstat(filepath.Join(outside, "x"))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		afs := aferosync.NewOsFs(t.TempDir())
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./a/f",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some other text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.SymlinkIfPossible(outside, "a")
+		require.Nil(t, err)
+		err = afs.SymlinkIfPossible(filepath.Join(outside, "f"), "l")
+		require.Nil(t, err)
+		err = afs.MkdirAll(filepath.Join(".", outside), 0755)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, filepath.Join(".", outside, "g"), []byte("inside"), 0644)
+		require.Nil(t, err)
+
+		// sync
+		// the anonymous struct hides the optional interfaces of afs, so that the undo and the diff
+		// read a/f instead of failing on its xattrs
+		undo := bytes.Buffer{}
+		_, err = aferosync.New(struct{ afero.Fs }{afs}, tar.NewReader(bytes.NewBuffer(bts)), aferosync.WithOwnership(false), aferosync.WithSymlinks(false), aferosync.WithHardLinks(false), aferosync.WithUndo(&undo), aferosync.WithContentDiff(1024)).Run()
+		assert.NotNil(t, err)
+
+		// assert
+		assert.False(t, bytes.Contains(undo.Bytes(), []byte("some text")), "undo holds the content of a file outside the root")
+
+		_, err = afs.Open("a/f")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = afs.Stat("l")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, _, err = afs.LstatIfPossible("a/f")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		// symlinks resolve inside the root
+		bts, err = afero.ReadFile(afs, "a/g")
+		require.Nil(t, err)
+		assert.Equal(t, "inside", string(bts))
+
+		fi, err := afs.Stat("a")
+		require.Nil(t, err)
+		assert.Equal(t, "a", fi.Name())
+		assert.True(t, fi.IsDir())
+	})
+
+	t.Run("Ops", func(t *testing.T) {
+		afs := aferosync.NewOsFs(t.TempDir())
+
+		// build disk
+		err := afero.WriteFile(afs, "f", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afs.SymlinkIfPossible(outside, "a")
+		require.Nil(t, err)
+		err = afs.SymlinkIfPossible(filepath.Join(outside, "f"), "l")
+		require.Nil(t, err)
+
+		mtime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		for _, op := range []struct {
+			name string
+			fn   func() error
+		}{
+			{"OpenFile/Ancestor", func() error {
+				_, err := afs.OpenFile("a/x", os.O_RDWR|os.O_CREATE, 0644)
+				return err
+			}},
+			{"OpenFile/Symlink", func() error {
+				_, err := afs.OpenFile("l", os.O_WRONLY|os.O_TRUNC, 0644)
+				return err
+			}},
+			{"Mkdir", func() error { return afs.Mkdir("a/d", 0755) }},
+			{"MkdirAll", func() error { return afs.MkdirAll("a/d/e", 0755) }},
+			{"Remove", func() error { return afs.Remove("a/f") }},
+			{"RemoveAll", func() error { return afs.RemoveAll("a/f") }},
+			{"Rename/Old", func() error { return afs.Rename("a/f", "g") }},
+			{"Rename/New", func() error { return afs.Rename("f", "a/g") }},
+			{"Chmod/Ancestor", func() error { return afs.Chmod("a/f", 0777) }},
+			{"Chmod/Symlink", func() error { return afs.Chmod("l", 0777) }},
+			{"Chown/Ancestor", func() error { return afs.Chown("a/f", 1, 1) }},
+			{"Chown/Symlink", func() error { return afs.Chown("l", 1, 1) }},
+			{"Lchown", func() error { return afs.Lchown("a/f", 1, 1) }},
+			{"Chtimes", func() error { return afs.Chtimes("a/f", mtime, mtime) }},
+			{"Link", func() error { return afs.Link("f", "a/g") }},
+			{"Symlink", func() error { return afs.SymlinkIfPossible("f", "a/g") }},
+			{"Setxattr/Ancestor", func() error { return afs.Setxattr("a/f", "user.test", []byte("value")) }},
+			{"Setxattr/Symlink", func() error { return afs.Setxattr("l", "user.test", []byte("value")) }},
+			{"Lsetxattr", func() error { return afs.Lsetxattr("a/f", "user.test", []byte("value")) }},
+			{"Removexattr", func() error { return afs.Removexattr("l", "user.test") }},
+		} {
+			assert.NotNil(t, op.fn(), op.name)
+		}
+
+		// assert
+		entries, err := os.ReadDir(outside)
+		require.Nil(t, err)
+		require.Len(t, entries, 1)
+
+		fi, err := os.Stat(filepath.Join(outside, "f"))
+		require.Nil(t, err)
+		assert.Equal(t, fs.FileMode(0644), fi.Mode())
+		assert.NotEqual(t, mtime, fi.ModTime().UTC())
+		assert.Equal(t, uint32(os.Geteuid()), fi.Sys().(*syscall.Stat_t).Uid)
+
+		bts, err := os.ReadFile(filepath.Join(outside, "f"))
+		require.Nil(t, err)
+		assert.Equal(t, "some text", string(bts))
+
+		names, err := aferosync.NewOsFs(outside).Listxattr("f")
+		require.Nil(t, err)
+		assert.Empty(t, names)
+	})
+}
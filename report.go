@@ -0,0 +1,31 @@
+package aferosync
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteReport writes updates to w one per line, each followed by its content diff if it has one.
+func WriteReport(w io.Writer, updates []PathUpdate) error {
+	for _, upd := range updates {
+		if _, err := fmt.Fprintln(w, upd.String()); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+
+		if upd.Diff == "" {
+			continue
+		}
+
+		diff := upd.Diff
+		if !strings.HasSuffix(diff, "\n") {
+			diff += "\n"
+		}
+
+		if _, err := io.WriteString(w, diff); err != nil {
+			return fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+
+	return nil
+}
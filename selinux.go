@@ -0,0 +1,175 @@
+package aferosync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	selinuxXattr  = "security.selinux"
+	selinuxConfig = "etc/selinux/config"
+)
+
+type fileContext struct {
+	re       *regexp.Regexp
+	literal  bool
+	fileType fs.FileMode
+	anyType  bool
+	context  string
+}
+
+// fileContexts is a parsed SELinux file_contexts file and its .local counterpart. Like libselinux,
+// it gives precedence to specs without regex meta characters in either file and, among those, to
+// specs defined last.
+type fileContexts []fileContext
+
+var fileContextTypes = map[string]fs.FileMode{
+	"--": 0,
+	"-d": fs.ModeDir,
+	"-l": fs.ModeSymlink,
+	"-c": fs.ModeDevice | fs.ModeCharDevice,
+	"-b": fs.ModeDevice,
+	"-s": fs.ModeSocket,
+	"-p": fs.ModeNamedPipe,
+}
+
+// parseFileContexts parses the specs of a file_contexts file in the order they're defined.
+func parseFileContexts(r io.Reader) (fileContexts, error) {
+	var specs fileContexts
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 2 or 3 fields, got %d", lineNo, len(fields))
+		}
+
+		spec := fileContext{anyType: true, context: fields[len(fields)-1]}
+		if len(fields) == 3 {
+			fileType, ok := fileContextTypes[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown file type: %s", lineNo, fields[1])
+			}
+			spec.fileType = fileType
+			spec.anyType = false
+		}
+
+		re, err := regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		spec.re = re
+		spec.literal = regexp.QuoteMeta(fields[0]) == fields[0]
+
+		specs = append(specs, spec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+// loadFileContexts reads file_contexts at name in fsys followed by its optional .local
+// counterpart. If name is empty, the file_contexts of the policy configured in
+// etc/selinux/config is used.
+func loadFileContexts(fsys afero.Fs, name string) (fileContexts, error) {
+	if name == "" {
+		var err error
+		if name, err = policyFileContexts(fsys); err != nil {
+			return nil, err
+		}
+	}
+
+	var specs fileContexts
+	for _, p := range []string{name, name + ".local"} {
+		f, err := fsys.Open(p)
+		if p != name && errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to open file contexts: %s: %w", p, err)
+		}
+
+		fileSpecs, err := parseFileContexts(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file contexts: %s: %w", p, err)
+		}
+
+		specs = append(specs, fileSpecs...)
+	}
+
+	// libselinux sorts the specs of both files together, regexes first
+	slices.SortStableFunc(specs, func(a, b fileContext) int {
+		switch {
+		case a.literal == b.literal:
+			return 0
+		case a.literal:
+			return 1
+		default:
+			return -1
+		}
+	})
+
+	return specs, nil
+}
+
+func policyFileContexts(fsys afero.Fs) (string, error) {
+	f, err := fsys.Open(selinuxConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to open selinux config: %w", err)
+	}
+	defer f.Close()
+
+	policy := "targeted"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "SELINUXTYPE="); ok {
+			policy = strings.Trim(v, `"'`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read selinux config: %w", err)
+	}
+
+	return path.Join("etc/selinux", policy, "contexts/files/file_contexts"), nil
+}
+
+// Lookup returns the context for the local path p of the given file type. It returns false
+// if no spec matches or the matching spec's context is <<none>>.
+func (fc fileContexts) Lookup(p string, fileType fs.FileMode) (string, bool) {
+	abs := "/" + p
+	if p == "." {
+		abs = "/"
+	}
+
+	for i := len(fc) - 1; i >= 0; i-- {
+		spec := fc[i]
+		if !spec.anyType && spec.fileType != fileType.Type() {
+			continue
+		}
+		if !spec.re.MatchString(abs) {
+			continue
+		}
+		if spec.context == "<<none>>" {
+			return "", false
+		}
+		return spec.context, true
+	}
+
+	return "", false
+}
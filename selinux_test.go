@@ -0,0 +1,225 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSELinux(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("SELinux", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		xattrer := afs.(aferosync.Xattrer)
+
+		// build policy
+		policyFs := afero.NewMemMapFs()
+		err = afero.WriteFile(policyFs, "file_contexts", []byte(`# comment
+/.*              system_u:object_r:default_t:s0
+/bin(/.*)?       system_u:object_r:bin_t:s0
+/bin         -d  system_u:object_r:bin_dir_t:s0
+/etc/motd        <<none>>
+`), 0644)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./bin/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./bin/ping",
+				Mode:    0755,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:     "./etc/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./etc/motd",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("bin", 0755)
+		require.Nil(t, err)
+		err = xattrer.Setxattr("bin", "security.selinux", []byte("system_u:object_r:bin_dir_t:s0\x00"))
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "bin/ping", []byte("some text"), 0755)
+		require.Nil(t, err)
+		err = afs.Chtimes("bin/ping", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = afs.Chtimes("bin", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+
+		// sync
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithSELinuxFileContexts(policyFs, "file_contexts"))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, aferosync.PathUpdate{
+			Path: "bin/ping",
+			Update: aferosync.Update{
+				Xattrs: []string{"security.selinux"},
+			},
+		}, updates[0])
+		assert.Equal(t, aferosync.Summary{
+			Added:        2,
+			Updated:      1,
+			Relabeled:    2,
+			Unchanged:    1,
+			Files:        2,
+			Dirs:         2,
+			BytesRead:    18,
+			BytesWritten: 9,
+		}, summary(sync))
+
+		for path, label := range map[string]string{
+			"bin":      "system_u:object_r:bin_dir_t:s0\x00",
+			"bin/ping": "system_u:object_r:bin_t:s0\x00",
+			"etc":      "system_u:object_r:default_t:s0\x00",
+		} {
+			value, err := xattrer.Getxattr(path, "security.selinux")
+			require.Nil(t, err)
+			assert.Equal(t, label, string(value), path)
+		}
+
+		names, err := xattrer.Listxattr("etc/motd")
+		require.Nil(t, err)
+		assert.Empty(t, names)
+
+		aferosynctest.AssertEqualTars(t, bts, afs)
+	})
+
+	t.Run("SELinux/TarLabel", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		xattrer := afs.(aferosync.Xattrer)
+
+		// build policy
+		policyFs := afero.NewMemMapFs()
+		err = afero.WriteFile(policyFs, "file_contexts", []byte(`/.*    system_u:object_r:default_t:s0
+/motd   <<none>>
+`), 0644)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./issue",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./motd",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.selinux": "system_u:object_r:etc_t:s0\x00",
+				},
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithXattrs(true), aferosync.WithSELinuxFileContexts(policyFs, "file_contexts"))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		assert.Equal(t, 1, sync.Summary().Relabeled)
+
+		value, err := xattrer.Getxattr("motd", "security.selinux")
+		require.Nil(t, err)
+		assert.Equal(t, "system_u:object_r:etc_t:s0\x00", string(value))
+	})
+
+	t.Run("SELinux/Local", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		xattrer := afs.(aferosync.Xattrer)
+
+		// build policy
+		policyFs := afero.NewMemMapFs()
+		err = afero.WriteFile(policyFs, "file_contexts", []byte(`/.*    system_u:object_r:default_t:s0
+/motd   system_u:object_r:etc_t:s0
+`), 0644)
+		require.Nil(t, err)
+		err = afero.WriteFile(policyFs, "file_contexts.local", []byte(`/mo.*   system_u:object_r:local_t:s0
+`), 0644)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./motd",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./motd2",
+				Mode:    0644,
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// sync
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithSELinuxFileContexts(policyFs, "file_contexts"))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		for path, label := range map[string]string{
+			"motd":  "system_u:object_r:etc_t:s0\x00",
+			"motd2": "system_u:object_r:local_t:s0\x00",
+		} {
+			value, err := xattrer.Getxattr(path, "security.selinux")
+			require.Nil(t, err)
+			assert.Equal(t, label, string(value), path)
+		}
+	})
+}
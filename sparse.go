@@ -0,0 +1,67 @@
+package aferosync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+)
+
+const sparseBlockSize = 4096
+
+// PunchHoler is implemented by afero.File values that can deallocate a byte range, for example
+// with fallocate(FALLOC_FL_PUNCH_HOLE). Files that don't implement it rely on Seek past the end of
+// file leaving a hole.
+type PunchHoler interface {
+	PunchHole(offset, length int64) error
+}
+
+// writeSparse copies size bytes from r to f, turning zero blocks into holes. Holes in sparse tar
+// entries read back as zeros, so this honours GNU and PAX sparse maps as well as detecting zero
+// blocks in regular entries.
+func writeSparse(f afero.File, r io.Reader, size int64) error {
+	var holes [][2]int64
+	buf := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+
+	var off int64
+	for off < size {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), size-off)])
+		if err != nil {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+
+		if bytes.Equal(buf[:n], zeros[:n]) {
+			if len(holes) > 0 && holes[len(holes)-1][0]+holes[len(holes)-1][1] == off {
+				holes[len(holes)-1][1] += int64(n)
+			} else {
+				holes = append(holes, [2]int64{off, int64(n)})
+			}
+		} else {
+			if _, err := f.Seek(off, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek: %w", err)
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to write: %w", err)
+			}
+		}
+
+		off += int64(n)
+	}
+
+	// extend the file over a trailing hole
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate: %w", err)
+	}
+
+	if punchHoler, ok := f.(PunchHoler); ok {
+		for _, hole := range holes {
+			if err := punchHoler.PunchHole(hole[0], hole[1]); err != nil {
+				return fmt.Errorf("failed to punch hole: %d+%d: %w", hole[0], hole[1], err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1180 @@
+package aferosync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gaboose/aferosync/memfs"
+	"github.com/spf13/afero"
+)
+
+// upperIno is added to the inode numbers of staged files so they don't collide with base inodes.
+const upperIno = math.MaxInt>>1 + 1
+
+// Stage is a copy-on-write afero.Fs that keeps all changes in memory on top of base, which is
+// only read from until Commit. Unlike afero.NewCopyOnWriteFs it records deletes, ownership,
+// xattrs and hard links and implements the aferosync optional interfaces, so a Sync can run
+// against it with all features enabled.
+//
+// Files are copied up from base on their first change. Copying up a hard linked file copies up its
+// other base paths as links to it, so committing keeps them linked. Symlinks in the middle of a path are resolved by each layer
+// separately. A Stage isn't safe for concurrent use.
+type Stage struct {
+	base  afero.Fs
+	upper *memfs.Fs
+
+	// rootCopied is set once the base root metadata has been copied to the upper root
+	rootCopied bool
+
+	// whiteouts are base paths deleted in the stage, hiding their subtrees
+	whiteouts map[string]struct{}
+
+	// copiedUp maps staged inodes to the base paths they were copied from, dirty holds the ones
+	// that have been opened for writing since
+	copiedUp map[int]string
+	dirty    map[int]struct{}
+
+	// baseLinks maps the inodes of hard linked base files to their paths, it's built on the first
+	// copy up of a hard linked file
+	baseLinks map[int][]string
+}
+
+var (
+	_ afero.Fs        = (*Stage)(nil)
+	_ afero.Symlinker = (*Stage)(nil)
+	_ Lchowner        = (*Stage)(nil)
+	_ Linker          = (*Stage)(nil)
+	_ Xattrer         = (*Stage)(nil)
+)
+
+// NewStage returns an empty Stage on top of base.
+func NewStage(base afero.Fs) *Stage {
+	s := &Stage{base: base}
+	s.Discard()
+	return s
+}
+
+// Discard throws away all staged changes.
+func (s *Stage) Discard() {
+	s.upper = memfs.New()
+	s.rootCopied = false
+	s.whiteouts = map[string]struct{}{}
+	s.copiedUp = map[int]string{}
+	s.dirty = map[int]struct{}{}
+	s.baseLinks = nil
+}
+
+// Commit replays the staged changes onto base and empties the stage. Deleted paths are removed
+// first, then staged entries are written in lexical order and directory metadata is applied last,
+// deepest first. If Commit fails, base is left partially updated and the stage is kept, so Commit
+// can be retried.
+func (s *Stage) Commit() error {
+	whiteouts := make([]string, 0, len(s.whiteouts))
+	for path := range s.whiteouts {
+		whiteouts = append(whiteouts, path)
+	}
+	sort.Strings(whiteouts)
+
+	for _, path := range whiteouts {
+		if err := s.base.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove: %s: %w", path, err)
+		}
+	}
+
+	// staged inode -> first committed path
+	inodes := map[int]string{}
+	var dirs []string
+
+	err := afero.Walk(s.upper, ".", func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path = normalizePath(path)
+		if path == "." {
+			if s.rootCopied {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		baseFi, _, err := LstatOrStat(s.base, path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to stat: %s: %w", path, err)
+		}
+
+		if fi.IsDir() {
+			if baseFi != nil && !baseFi.IsDir() {
+				if err := s.base.Remove(path); err != nil {
+					return fmt.Errorf("failed to remove: %s: %w", path, err)
+				}
+				baseFi = nil
+			}
+
+			if baseFi == nil {
+				if err := s.base.Mkdir(path, 0700); err != nil {
+					return fmt.Errorf("failed to make dir: %s: %w", path, err)
+				}
+			}
+
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		ino := fi.(*memfs.FileInfo).Ino()
+		if leader, ok := inodes[ino]; ok {
+			return s.commitLink(leader, path, baseFi)
+		}
+		inodes[ino] = path
+
+		switch fi.Mode().Type() {
+		case fs.ModeSymlink:
+			if err := s.commitSymlink(path, baseFi); err != nil {
+				return err
+			}
+		case 0:
+			// files copied up for a metadata change keep their base content
+			_, dirty := s.dirty[ino]
+			if origin, ok := s.copiedUp[ino]; !ok || origin != path || dirty || baseFi == nil {
+				if err := s.commitContent(path, baseFi); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported file type: %s: %s", path, fi.Mode().Type())
+		}
+
+		return s.commitStat(path, fi)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+
+	// adding entries changes the modtime of their parent directories
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := s.upper.Stat(dirs[i])
+		if err != nil {
+			return fmt.Errorf("failed to stat: %s: %w", dirs[i], err)
+		}
+
+		if err := s.commitStat(dirs[i], fi); err != nil {
+			return fmt.Errorf("failed to commit: %w", err)
+		}
+	}
+
+	s.Discard()
+	return nil
+}
+
+func (s *Stage) commitLink(leader, path string, baseFi fs.FileInfo) error {
+	linker, ok := s.base.(Linker)
+	if !ok {
+		return fmt.Errorf("failed to link: %s: base doesn't implement aferosync.Linker", path)
+	}
+
+	if baseFi != nil {
+		if err := s.base.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove: %s: %w", path, err)
+		}
+	}
+
+	if err := linker.Link(leader, path); err != nil {
+		return fmt.Errorf("failed to link: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (s *Stage) commitSymlink(path string, baseFi fs.FileInfo) error {
+	symlinker, ok := s.base.(afero.Symlinker)
+	if !ok {
+		return fmt.Errorf("failed to make symlink: %s: base doesn't implement afero.Symlinker", path)
+	}
+
+	target, err := s.upper.ReadlinkIfPossible(path)
+	if err != nil {
+		return fmt.Errorf("failed to read link: %s: %w", path, err)
+	}
+
+	if baseFi != nil {
+		if err := s.base.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove: %s: %w", path, err)
+		}
+	}
+
+	if err := symlinker.SymlinkIfPossible(target, path); err != nil {
+		return fmt.Errorf("failed to make symlink: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (s *Stage) commitContent(path string, baseFi fs.FileInfo) error {
+	// write a new inode so that other links to the base file keep their content
+	if baseFi != nil {
+		if err := s.base.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove: %s: %w", path, err)
+		}
+	}
+
+	src, err := s.upper.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open: %s: %w", path, err)
+	}
+	defer src.Close()
+
+	dst, err := s.base.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create: %s: %w", path, err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to write file: %s: %w", path, err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// commitStat copies the metadata of the staged file fi at path to base where it differs.
+func (s *Stage) commitStat(path string, fi fs.FileInfo) error {
+	baseFi, _, err := LstatOrStat(s.base, path)
+	if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", path, err)
+	}
+
+	symlink := fi.Mode().Type() == fs.ModeSymlink
+
+	// ownership can only be committed to bases that track it
+	if baseOwner, ok := baseFi.(FileInfoOwner); ok {
+		owner := fi.(FileInfoOwner)
+		if owner.Uid() != baseOwner.Uid() || owner.Gid() != baseOwner.Gid() {
+			if symlink {
+				lchowner, ok := s.base.(Lchowner)
+				if !ok {
+					return fmt.Errorf("failed to lchown: %s: base doesn't implement aferosync.Lchowner", path)
+				}
+				err = lchowner.Lchown(path, owner.Uid(), owner.Gid())
+			} else {
+				err = s.base.Chown(path, owner.Uid(), owner.Gid())
+			}
+			if err != nil {
+				return fmt.Errorf("failed to chown: %s: %w", path, err)
+			}
+		}
+	}
+
+	if !symlink && fi.Mode() != baseFi.Mode() {
+		if err := s.base.Chmod(path, fi.Mode()); err != nil {
+			return fmt.Errorf("failed to chmod: %s: %w", path, err)
+		}
+	}
+
+	want, err := fsXattrs(s.upper, path, symlink)
+	if err != nil {
+		return err
+	}
+
+	if xattrer, ok := s.base.(Xattrer); ok {
+		if _, err := syncXattrs(xattrer, path, symlink, want, true, nil); err != nil {
+			return err
+		}
+	} else if len(want) > 0 {
+		return fmt.Errorf("failed to set xattrs: %s: base doesn't implement aferosync.Xattrer", path)
+	}
+
+	if !fi.ModTime().Equal(baseFi.ModTime()) {
+		if err := s.base.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+			return fmt.Errorf("failed to chtimes: %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// hidden reports whether path or one of its ancestors has been deleted from base.
+func (s *Stage) hidden(path string) bool {
+	for ; path != "."; path = filepath.Dir(path) {
+		if _, ok := s.whiteouts[path]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lstat returns the staged file at path if there's one, or the base file otherwise.
+func (s *Stage) lstat(path string) (fs.FileInfo, bool, error) {
+	if path != "." || s.rootCopied {
+		if fi, _, err := s.upper.LstatIfPossible(path); err == nil {
+			return stageFileInfo{fi.(*memfs.FileInfo)}, true, nil
+		}
+	}
+
+	if s.hidden(path) {
+		return nil, false, &fs.PathError{Op: "lstat", Path: path, Err: fs.ErrNotExist}
+	}
+
+	fi, _, err := LstatOrStat(s.base, path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	fi, err = s.baseLinkInfo(fi)
+	return fi, false, err
+}
+
+// baseLinkInfo returns the hard linked base file fi with its deleted links left out of its link
+// count.
+func (s *Stage) baseLinkInfo(fi fs.FileInfo) (fs.FileInfo, error) {
+	inoer, ok := fi.(FileInfoInoer)
+	if _, ok2 := fi.(FileInfoOwner); !ok || !ok2 {
+		return fi, nil
+	}
+	if nlinker, ok := fi.(FileInfoNlinker); !ok || !fi.Mode().IsRegular() || nlinker.Nlink() < 2 {
+		return fi, nil
+	}
+
+	if err := s.findBaseLinks(); err != nil {
+		return nil, err
+	}
+
+	nlink := 0
+	for _, link := range s.baseLinks[inoer.Ino()] {
+		if !s.hidden(link) {
+			nlink++
+		}
+	}
+
+	return baseLinkFileInfo{FileInfo: fi, nlink: nlink}, nil
+}
+
+// baseExists reports whether base has a visible file at path.
+func (s *Stage) baseExists(path string) bool {
+	if s.hidden(path) {
+		return false
+	}
+
+	_, _, err := LstatOrStat(s.base, path)
+	return err == nil
+}
+
+// resolve follows the symlinks at the end of path. It returns a nil FileInfo if the resolved path
+// doesn't exist.
+func (s *Stage) resolve(path string) (string, fs.FileInfo, bool, error) {
+	path = normalizePath(path)
+
+	for range 40 {
+		fi, upper, err := s.lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil, false, nil
+		} else if err != nil {
+			return path, nil, false, err
+		}
+
+		if fi.Mode().Type() != fs.ModeSymlink {
+			return path, fi, upper, nil
+		}
+
+		target, err := s.ReadlinkIfPossible(path)
+		if err != nil {
+			return path, nil, false, err
+		}
+
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = normalizePath(target)
+	}
+
+	return path, nil, false, &fs.PathError{Op: "stat", Path: path, Err: syscall.ELOOP}
+}
+
+// copyUp copies the file at path, without its children, from base to the stage unless it's
+// already staged. The modtime of the staged parent directory is preserved.
+func (s *Stage) copyUp(path string) error {
+	fi, upper, err := s.lstat(path)
+	if err != nil {
+		return err
+	}
+	if upper {
+		return nil
+	}
+
+	if path == "." {
+		s.rootCopied = true
+		return s.copyUpStat(path, fi)
+	}
+
+	parent := filepath.Dir(path)
+	if err := s.copyUp(parent); err != nil {
+		return err
+	}
+
+	parentFi, err := s.upper.Stat(parent)
+	if err != nil {
+		return err
+	}
+
+	switch fi.Mode().Type() {
+	case fs.ModeDir:
+		err = s.upper.Mkdir(path, 0700)
+	case fs.ModeSymlink:
+		var target string
+		if target, err = s.ReadlinkIfPossible(path); err == nil {
+			err = s.upper.SymlinkIfPossible(target, path)
+		}
+	case 0:
+		err = s.copyUpContent(path)
+	default:
+		err = fmt.Errorf("unsupported file type: %s", fi.Mode().Type())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy up: %s: %w", path, err)
+	}
+
+	if err := s.upper.Chtimes(parent, parentFi.ModTime(), parentFi.ModTime()); err != nil {
+		return err
+	}
+
+	if err := s.copyUpStat(path, fi); err != nil {
+		return err
+	}
+
+	return s.copyUpLinks(path, fi)
+}
+
+// copyUpLinks links the other visible base paths of the hard linked base file fi to its staged copy
+// at path. The modtimes of their staged parent directories are preserved.
+func (s *Stage) copyUpLinks(path string, fi fs.FileInfo) error {
+	inoer, ok := fi.(FileInfoInoer)
+	if !ok {
+		return nil
+	}
+	if nlinker, ok := fi.(FileInfoNlinker); !ok || !fi.Mode().IsRegular() || nlinker.Nlink() < 2 {
+		return nil
+	}
+
+	if err := s.findBaseLinks(); err != nil {
+		return err
+	}
+
+	for _, link := range s.baseLinks[inoer.Ino()] {
+		// skip deleted and already staged paths
+		if _, upper, err := s.lstat(link); errors.Is(err, fs.ErrNotExist) || upper {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		parent := filepath.Dir(link)
+		if err := s.copyUp(parent); err != nil {
+			return err
+		}
+
+		parentFi, err := s.upper.Stat(parent)
+		if err != nil {
+			return err
+		}
+
+		if err := s.upper.Link(path, link); err != nil {
+			return fmt.Errorf("failed to copy up: %s: %w", link, err)
+		}
+
+		if err := s.upper.Chtimes(parent, parentFi.ModTime(), parentFi.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findBaseLinks builds baseLinks unless it's already built.
+func (s *Stage) findBaseLinks() error {
+	if s.baseLinks != nil {
+		return nil
+	}
+
+	baseLinks := map[int][]string{}
+	err := afero.Walk(s.base, ".", func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		inoer, ok := fi.(FileInfoInoer)
+		if nlinker, ok2 := fi.(FileInfoNlinker); ok && ok2 && fi.Mode().IsRegular() && nlinker.Nlink() > 1 {
+			baseLinks[inoer.Ino()] = append(baseLinks[inoer.Ino()], normalizePath(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find hard links: %w", err)
+	}
+
+	s.baseLinks = baseLinks
+	return nil
+}
+
+func (s *Stage) copyUpContent(path string) error {
+	src, err := s.base.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := s.upper.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	fi, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	s.copiedUp[fi.(*memfs.FileInfo).Ino()] = path
+
+	return nil
+}
+
+// copyUpStat copies the metadata of the base file fi to the staged file at path.
+func (s *Stage) copyUpStat(path string, fi fs.FileInfo) error {
+	symlink := fi.Mode().Type() == fs.ModeSymlink
+
+	if owner, ok := fi.(FileInfoOwner); ok {
+		if err := s.upper.Lchown(path, owner.Uid(), owner.Gid()); err != nil {
+			return err
+		}
+	}
+
+	if xattrer, ok := s.base.(Xattrer); ok {
+		xattrs, err := fsXattrs(xattrer, path, symlink)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range xattrs {
+			if err := s.upper.Lsetxattr(path, name, []byte(value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !symlink {
+		if err := s.upper.Chmod(path, fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return s.upper.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+// copyUpTree copies path and all its descendants to the stage.
+func (s *Stage) copyUpTree(path string) error {
+	if err := s.copyUp(path); err != nil {
+		return err
+	}
+
+	fi, _, err := s.lstat(path)
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+
+	names, err := s.readDirNames(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.copyUpTree(filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+
+	// copying up children touches the staged directory
+	return s.upper.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+// touch sets the modtime of the staged directory dir to now, as adding or removing an entry
+// would.
+func (s *Stage) touch(dir string) error {
+	now := time.Now()
+	return s.upper.Chtimes(dir, now, now)
+}
+
+// readDirNames returns the sorted names in the directory at path, merged from both layers.
+func (s *Stage) readDirNames(path string) ([]string, error) {
+	names := map[string]struct{}{}
+
+	if fi, upper, err := s.lstat(path); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	} else if upper {
+		upperNames, err := readDirNames(s.upper, path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range upperNames {
+			names[name] = struct{}{}
+		}
+	}
+
+	if fi, _, err := LstatOrStat(s.base, path); err == nil && fi.IsDir() && !s.hidden(path) {
+		baseNames, err := readDirNames(s.base, path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range baseNames {
+			if _, ok := s.whiteouts[filepath.Join(path, name)]; !ok {
+				names[name] = struct{}{}
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+func (s *Stage) Name() string {
+	return "Stage"
+}
+
+func (s *Stage) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (s *Stage) Mkdir(name string, perm os.FileMode) error {
+	path := normalizePath(name)
+
+	if _, _, err := s.lstat(path); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	if err := s.copyUp(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return s.upper.Mkdir(path, perm)
+}
+
+func (s *Stage) MkdirAll(name string, perm os.FileMode) error {
+	path := normalizePath(name)
+	if path == "." {
+		return nil
+	}
+
+	if err := s.MkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+
+	_, fi, _, err := s.resolve(path)
+	if err != nil {
+		return err
+	} else if fi == nil {
+		return s.Mkdir(path, perm)
+	} else if !fi.IsDir() {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	return nil
+}
+
+func (s *Stage) Open(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *Stage) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	path, fi, upper, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+
+	switch {
+	case fi == nil && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case fi == nil:
+		if err := s.copyUp(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		return s.upper.OpenFile(path, flag, perm)
+	case fi.IsDir() && write:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case fi.IsDir():
+		return &stageDir{stage: s, name: name, path: path, fi: fi}, nil
+	case write:
+		if err := s.copyUp(path); err != nil {
+			return nil, err
+		}
+
+		f, err := s.upper.OpenFile(path, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		s.dirty[fi.(*memfs.FileInfo).Ino()] = struct{}{}
+
+		return f, nil
+	case upper:
+		return s.upper.OpenFile(path, flag, perm)
+	default:
+		return s.base.OpenFile(path, flag, perm)
+	}
+}
+
+func (s *Stage) Remove(name string) error {
+	path := normalizePath(name)
+
+	fi, upper, err := s.lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		names, err := s.readDirNames(path)
+		if err != nil {
+			return err
+		} else if len(names) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	return s.remove(path, upper)
+}
+
+func (s *Stage) RemoveAll(name string) error {
+	path := normalizePath(name)
+
+	_, upper, err := s.lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if path == "." {
+		names, err := s.readDirNames(path)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := s.RemoveAll(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return s.remove(path, upper)
+}
+
+// remove deletes path and its children from both layers.
+func (s *Stage) remove(path string, upper bool) error {
+	parent := filepath.Dir(path)
+	if err := s.copyUp(parent); err != nil {
+		return err
+	}
+
+	if upper {
+		if err := s.upper.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	if s.baseExists(path) {
+		for whiteout := range s.whiteouts {
+			if strings.HasPrefix(whiteout, path+"/") {
+				delete(s.whiteouts, whiteout)
+			}
+		}
+		s.whiteouts[path] = struct{}{}
+
+		return s.touch(parent)
+	}
+
+	return nil
+}
+
+func (s *Stage) Rename(oldname, newname string) error {
+	oldPath, newPath := normalizePath(oldname), normalizePath(newname)
+
+	oldFi, _, err := s.lstat(oldPath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if err := s.copyUpTree(oldPath); err != nil {
+		return err
+	}
+
+	if err := s.copyUp(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+
+	// make the base file at newPath disappear if it would be replaced
+	if newFi, upper, err := s.lstat(newPath); err == nil && !upper {
+		switch {
+		case newFi.IsDir() && !oldFi.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+		case !newFi.IsDir() && oldFi.IsDir():
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+		case newFi.IsDir():
+			if names, err := s.readDirNames(newPath); err != nil {
+				return err
+			} else if len(names) > 0 {
+				return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.ENOTEMPTY}
+			}
+		}
+
+		s.whiteouts[newPath] = struct{}{}
+	}
+
+	if err := s.upper.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	if s.baseExists(oldPath) {
+		s.whiteouts[oldPath] = struct{}{}
+	}
+
+	return nil
+}
+
+func (s *Stage) Stat(name string) (os.FileInfo, error) {
+	_, fi, _, err := s.resolve(name)
+	if err != nil {
+		return nil, err
+	} else if fi == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return fi, nil
+}
+
+func (s *Stage) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, _, err := s.lstat(normalizePath(name))
+	return fi, true, err
+}
+
+// stageChange copies the file at name up and returns its staged path, following symlinks unless
+// nofollow is set.
+func (s *Stage) stageChange(name string, nofollow bool) (string, error) {
+	path := normalizePath(name)
+	if !nofollow {
+		var fi fs.FileInfo
+		var err error
+		if path, fi, _, err = s.resolve(name); err != nil {
+			return "", err
+		} else if fi == nil {
+			return "", &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+
+	if err := s.copyUp(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *Stage) Chmod(name string, mode os.FileMode) error {
+	path, err := s.stageChange(name, false)
+	if err != nil {
+		return err
+	}
+	return s.upper.Chmod(path, mode)
+}
+
+func (s *Stage) Chown(name string, uid, gid int) error {
+	path, err := s.stageChange(name, false)
+	if err != nil {
+		return err
+	}
+	return s.upper.Chown(path, uid, gid)
+}
+
+func (s *Stage) Lchown(name string, uid, gid int) error {
+	path, err := s.stageChange(name, true)
+	if err != nil {
+		return err
+	}
+	return s.upper.Lchown(path, uid, gid)
+}
+
+// Chtimes changes symlinks themselves rather than their targets, like memfs and afero-guestfs.
+func (s *Stage) Chtimes(name string, atime, mtime time.Time) error {
+	path, err := s.stageChange(name, true)
+	if err != nil {
+		return err
+	}
+	return s.upper.Chtimes(path, atime, mtime)
+}
+
+func (s *Stage) SymlinkIfPossible(oldname, newname string) error {
+	path := normalizePath(newname)
+
+	if _, _, err := s.lstat(path); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	if err := s.copyUp(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return s.upper.SymlinkIfPossible(oldname, path)
+}
+
+func (s *Stage) ReadlinkIfPossible(name string) (string, error) {
+	path := normalizePath(name)
+
+	_, upper, err := s.lstat(path)
+	if err != nil {
+		return "", err
+	} else if upper {
+		return s.upper.ReadlinkIfPossible(path)
+	}
+
+	reader, ok := s.base.(afero.LinkReader)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+	}
+
+	return reader.ReadlinkIfPossible(path)
+}
+
+func (s *Stage) Link(oldname, newname string) error {
+	oldPath, newPath := normalizePath(oldname), normalizePath(newname)
+
+	if _, _, err := s.lstat(newPath); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	if err := s.copyUp(oldPath); err != nil {
+		return err
+	}
+
+	if err := s.copyUp(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+
+	return s.upper.Link(oldPath, newPath)
+}
+
+// xattrLayer returns the staged path of name and the Xattrer of the layer it lives in, which is
+// nil if base doesn't implement Xattrer.
+func (s *Stage) xattrLayer(name string, nofollow bool) (string, Xattrer, error) {
+	path := normalizePath(name)
+
+	var upper bool
+	var err error
+	if nofollow {
+		_, upper, err = s.lstat(path)
+	} else {
+		var fi fs.FileInfo
+		path, fi, upper, err = s.resolve(name)
+		if err == nil && fi == nil {
+			err = &fs.PathError{Op: "getxattr", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if upper {
+		return path, s.upper, nil
+	}
+
+	xattrer, _ := s.base.(Xattrer)
+	return path, xattrer, nil
+}
+
+func (s *Stage) listxattr(name string, nofollow bool) ([]string, error) {
+	path, xattrer, err := s.xattrLayer(name, nofollow)
+	if err != nil || xattrer == nil {
+		return nil, err
+	} else if nofollow {
+		return xattrer.Llistxattr(path)
+	}
+	return xattrer.Listxattr(path)
+}
+
+func (s *Stage) getxattr(name, attr string, nofollow bool) ([]byte, error) {
+	path, xattrer, err := s.xattrLayer(name, nofollow)
+	if err != nil {
+		return nil, err
+	} else if xattrer == nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: syscall.ENODATA}
+	} else if nofollow {
+		return xattrer.Lgetxattr(path, attr)
+	}
+	return xattrer.Getxattr(path, attr)
+}
+
+func (s *Stage) Listxattr(name string) ([]string, error) {
+	return s.listxattr(name, false)
+}
+
+func (s *Stage) Getxattr(name, attr string) ([]byte, error) {
+	return s.getxattr(name, attr, false)
+}
+
+func (s *Stage) Setxattr(name, attr string, value []byte) error {
+	path, err := s.stageChange(name, false)
+	if err != nil {
+		return err
+	}
+	return s.upper.Setxattr(path, attr, value)
+}
+
+func (s *Stage) Removexattr(name, attr string) error {
+	path, err := s.stageChange(name, false)
+	if err != nil {
+		return err
+	}
+	return s.upper.Removexattr(path, attr)
+}
+
+func (s *Stage) Llistxattr(name string) ([]string, error) {
+	return s.listxattr(name, true)
+}
+
+func (s *Stage) Lgetxattr(name, attr string) ([]byte, error) {
+	return s.getxattr(name, attr, true)
+}
+
+func (s *Stage) Lsetxattr(name, attr string, value []byte) error {
+	path, err := s.stageChange(name, true)
+	if err != nil {
+		return err
+	}
+	return s.upper.Lsetxattr(path, attr, value)
+}
+
+func (s *Stage) Lremovexattr(name, attr string) error {
+	path, err := s.stageChange(name, true)
+	if err != nil {
+		return err
+	}
+	return s.upper.Lremovexattr(path, attr)
+}
+
+// stageFileInfo is the FileInfo of a staged file.
+type stageFileInfo struct {
+	*memfs.FileInfo
+}
+
+func (fi stageFileInfo) Ino() int {
+	return fi.FileInfo.Ino() + upperIno
+}
+
+// baseLinkFileInfo is the FileInfo of a hard linked base file, counting only its visible links.
+type baseLinkFileInfo struct {
+	fs.FileInfo
+	nlink int
+}
+
+func (fi baseLinkFileInfo) Uid() int   { return fi.FileInfo.(FileInfoOwner).Uid() }
+func (fi baseLinkFileInfo) Gid() int   { return fi.FileInfo.(FileInfoOwner).Gid() }
+func (fi baseLinkFileInfo) Ino() int   { return fi.FileInfo.(FileInfoInoer).Ino() }
+func (fi baseLinkFileInfo) Nlink() int { return fi.nlink }
+
+// stageDir is a directory opened for reading, listing the entries of both layers.
+type stageDir struct {
+	stage *Stage
+	name  string
+	path  string
+	fi    fs.FileInfo
+
+	names []string
+	read  bool
+}
+
+func (d *stageDir) err(op string) error {
+	return &fs.PathError{Op: op, Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *stageDir) Close() error                                 { return nil }
+func (d *stageDir) Name() string                                 { return d.name }
+func (d *stageDir) Stat() (os.FileInfo, error)                   { return d.fi, nil }
+func (d *stageDir) Sync() error                                  { return nil }
+func (d *stageDir) Read(p []byte) (int, error)                   { return 0, d.err("read") }
+func (d *stageDir) ReadAt(p []byte, off int64) (int, error)      { return 0, d.err("read") }
+func (d *stageDir) Seek(offset int64, whence int) (int64, error) { return 0, d.err("seek") }
+func (d *stageDir) Write(p []byte) (int, error)                  { return 0, d.err("write") }
+func (d *stageDir) WriteAt(p []byte, off int64) (int, error)     { return 0, d.err("write") }
+func (d *stageDir) WriteString(s string) (int, error)            { return 0, d.err("write") }
+func (d *stageDir) Truncate(size int64) error                    { return d.err("truncate") }
+
+func (d *stageDir) Readdirnames(n int) ([]string, error) {
+	if !d.read {
+		var err error
+		if d.names, err = d.stage.readDirNames(d.path); err != nil {
+			return nil, err
+		}
+		d.read = true
+	}
+
+	if n <= 0 {
+		names := d.names
+		d.names = nil
+		return names, nil
+	}
+
+	if len(d.names) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.names))
+	names := d.names[:n]
+	d.names = d.names[n:]
+	return names, nil
+}
+
+func (d *stageDir) Readdir(n int) ([]os.FileInfo, error) {
+	names, err := d.Readdirnames(n)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fi, _, err := d.stage.lstat(filepath.Join(d.path, name))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,363 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStage(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Stage", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tars
+		before, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./del/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./del/test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./chmod.txt",
+				Mode:    0644,
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./mod.txt",
+				Mode:    0644,
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text1",
+		}})
+		require.Nil(t, err)
+
+		after, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./chmod.txt",
+				Mode:    0600,
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:     "./dir/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./dir/add.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./mod.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("del", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chmod("del", fs.ModeDir|fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "del/test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "chmod.txt", []byte("some text"), 0644)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "mod.txt", []byte("some text1"), 0644)
+		require.Nil(t, err)
+		for _, name := range []string{"del/test.txt", "chmod.txt", "mod.txt", "del"} {
+			err = afs.Chtimes(name, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+		aferosynctest.AssertEqualTars(t, before, afs)
+
+		// sync and discard
+		stage := aferosync.NewStage(afs)
+		_, err = aferosync.New(stage, tar.NewReader(bytes.NewBuffer(after)), opts...).Run()
+		require.Nil(t, err)
+		aferosynctest.AssertEqualTars(t, after, stage)
+		aferosynctest.AssertEqualTars(t, before, afs)
+
+		stage.Discard()
+		aferosynctest.AssertEqualTars(t, before, stage)
+
+		// sync and commit
+		updates, err := aferosync.New(stage, tar.NewReader(bytes.NewBuffer(after)), opts...).Run()
+		require.Nil(t, err)
+		aferosynctest.AssertEqualTars(t, before, afs)
+
+		err = stage.Commit()
+		require.Nil(t, err)
+
+		// assert
+		aferosynctest.AssertEqualTars(t, after, afs)
+		aferosynctest.AssertEqualTars(t, after, stage)
+
+		updates2, err := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(after)), opts...).Run()
+		require.Nil(t, err)
+		assert.Equal(t, []aferosync.PathUpdate{}, updates2)
+		assert.Len(t, updates, 6)
+	})
+
+	t.Run("Stage/Xattrs", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		xattrer := afs.(aferosync.Xattrer)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.user.keep": "new",
+				},
+			},
+			Body: "some text",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afero.WriteFile(afs, "test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chtimes("test.txt", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+		require.Nil(t, err)
+		err = xattrer.Setxattr("test.txt", "user.keep", []byte("old"))
+		require.Nil(t, err)
+		err = xattrer.Setxattr("test.txt", "user.stale", []byte("value"))
+		require.Nil(t, err)
+
+		// sync and commit
+		stage := aferosync.NewStage(afs)
+		updates, err := aferosync.New(stage, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithXattrs(true))...).Run()
+		require.Nil(t, err)
+		assert.Equal(t, []aferosync.PathUpdate{{
+			Path: "test.txt",
+			Update: aferosync.Update{
+				Xattrs: []string{"user.keep", "user.stale"},
+			},
+		}}, updates)
+
+		err = stage.Commit()
+		require.Nil(t, err)
+
+		// assert
+		names, err := xattrer.Listxattr("test.txt")
+		require.Nil(t, err)
+		assert.Equal(t, []string{"user.keep"}, names)
+
+		value, err := xattrer.Getxattr("test.txt", "user.keep")
+		require.Nil(t, err)
+		assert.Equal(t, []byte("new"), value)
+	})
+}
+
+func testDryRun(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("DryRun", func(t *testing.T) {
+		treeCfg := aferosynctest.TreeConfig{Symlinks: true, HardLinks: true, Ownership: true}
+
+		r := rand.New(rand.NewPCG(3, 0))
+		for range 20 {
+			err := aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			a := aferosynctest.RandomTree(r, treeCfg)
+			b := aferosynctest.MutateTree(r, a, treeCfg)
+
+			err = a.WriteFs(afs)
+			require.Nil(t, err)
+			aBts, err := a.Tar()
+			require.Nil(t, err)
+			bBts, err := b.Tar()
+			require.Nil(t, err)
+
+			// dry run
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), append(opts, aferosync.WithDryRun(true))...)
+			dryUpdates, err := sync.Run()
+			require.Nil(t, err)
+
+			aferosynctest.AssertEqualTars(t, aBts, afs)
+
+			// sync
+			sync = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), opts...)
+			updates, err := sync.Run()
+			require.Nil(t, err)
+
+			assert.Equal(t, updates, dryUpdates)
+			aferosynctest.AssertEqualTars(t, bBts, afs)
+		}
+	})
+}
+
+func testLayer(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Layer", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tar
+		bts, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./add.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./keep.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./mod.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("del", fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "del/test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		for _, name := range []string{"keep.txt", "mod.txt"} {
+			err = afero.WriteFile(afs, name, []byte("some text"), fs.ModePerm)
+			require.Nil(t, err)
+			err = afs.Chtimes(name, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+
+		before := bytes.NewBuffer(nil)
+		err = aferosync.TarOut(afs, ".", before)
+		require.Nil(t, err)
+
+		// sync
+		layer := bytes.NewBuffer(nil)
+		sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bts)), append(opts, aferosync.WithLayer(layer))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		// assert
+		aferosynctest.AssertEqualTars(t, before.Bytes(), afs)
+		assert.Equal(t, aferosync.Summary{
+			Added:          1,
+			Updated:        1,
+			Deleted:        2,
+			Unchanged:      1,
+			Files:          3,
+			ModTimeChanges: 1,
+			ContentChanges: 1,
+			BytesRead:      28,
+			BytesFreed:     9,
+		}, summary(sync))
+
+		files, err := aferosynctest.ReadTar(layer.Bytes())
+		require.Nil(t, err)
+
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Header.Name)
+		}
+		assert.Equal(t, []string{"./.wh.del", "./", "./add.txt", "./mod.txt"}, names)
+
+		sync = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(layer.Bytes())), append(opts, aferosync.WithAdditive(true))...)
+		_, err = sync.Run()
+		require.Nil(t, err)
+
+		aferosynctest.AssertEqualTars(t, bts, afs)
+		assert.Equal(t, aferosync.Summary{
+			Added:          1,
+			Updated:        2,
+			Deleted:        2,
+			Files:          2,
+			Dirs:           1,
+			ModTimeChanges: 2,
+			ContentChanges: 1,
+			BytesRead:      19,
+			BytesWritten:   19,
+			BytesFreed:     9,
+		}, summary(sync))
+	})
+
+	t.Run("Layer/Random", func(t *testing.T) {
+		treeCfg := aferosynctest.TreeConfig{Symlinks: true, HardLinks: true, Ownership: true}
+
+		r := rand.New(rand.NewPCG(4, 0))
+		for range 20 {
+			err := aferosynctest.Clear(afs)
+			require.Nil(t, err)
+
+			a := aferosynctest.RandomTree(r, treeCfg)
+			b := aferosynctest.MutateTree(r, a, treeCfg)
+
+			err = a.WriteFs(afs)
+			require.Nil(t, err)
+			aBts, err := a.Tar()
+			require.Nil(t, err)
+			bBts, err := b.Tar()
+			require.Nil(t, err)
+
+			// export
+			layer := bytes.NewBuffer(nil)
+			sync := aferosync.New(afs, tar.NewReader(bytes.NewBuffer(bBts)), append(opts, aferosync.WithLayer(layer))...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			aferosynctest.AssertEqualTars(t, aBts, afs)
+
+			// apply
+			sync = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(layer.Bytes())), append(opts, aferosync.WithAdditive(true))...)
+			_, err = sync.Run()
+			require.Nil(t, err)
+
+			aferosynctest.AssertEqualTars(t, bBts, afs)
+		}
+	})
+}
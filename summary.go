@@ -1,11 +1,51 @@
 package aferosync
 
-import "fmt"
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+)
 
+// Summary counts the changes made by a sync. It's marshalable to JSON.
 type Summary struct {
-	Added   int
-	Updated int
-	Deleted int
+	Added    int `json:"added"`
+	Updated  int `json:"updated"`
+	Deleted  int `json:"deleted"`
+	Replaced int `json:"replaced"`
+
+	// Relabeled is the number of paths whose SELinux label has been set from the file_contexts
+	// policy, see WithSELinux
+	Relabeled int `json:"relabeled"`
+
+	// Unchanged is the number of tar entries that were already in sync, Skipped the number of tar
+	// entries left out because their type isn't enabled
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+
+	// Files, Dirs, Symlinks and HardLinks count the synced tar entries by type, changed or not
+	Files     int `json:"files"`
+	Dirs      int `json:"dirs"`
+	Symlinks  int `json:"symlinks"`
+	HardLinks int `json:"hard_links"`
+
+	// ModeChanges, OwnerChanges, ModTimeChanges and ContentChanges count the updated paths by
+	// changed attribute
+	ModeChanges    int `json:"mode_changes"`
+	OwnerChanges   int `json:"owner_changes"`
+	ModTimeChanges int `json:"modtime_changes"`
+	ContentChanges int `json:"content_changes"`
+
+	// BytesRead is the size of the file content in the tar, whether it's been copied or skipped
+	// because the file is unchanged. BytesWritten is the file content written to the fs, which is
+	// none in dry runs.
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+
+	// BytesFreed is the total size of the regular files whose last link has been deleted or replaced
+	BytesFreed int64 `json:"bytes_freed"`
+
+	// Duration is the wall-clock time from the first call to Sync.Next to the last one
+	Duration time.Duration `json:"duration_ns"`
 }
 
 func (s *Summary) Add(upd Update) {
@@ -13,11 +53,64 @@ func (s *Summary) Add(upd Update) {
 		s.Added++
 	} else if upd.Deleted {
 		s.Deleted++
+	} else if upd.Replaced {
+		s.Replaced++
 	} else {
 		s.Updated++
+
+		if upd.Mode != nil {
+			s.ModeChanges++
+		}
+		if upd.Uid != nil || upd.Gid != nil {
+			s.OwnerChanges++
+		}
+		if upd.ModTime != nil {
+			s.ModTimeChanges++
+		}
+		if upd.ContentChanged {
+			s.ContentChanges++
+		}
+	}
+
+	// rolled up descendants are deleted too
+	s.Deleted += upd.Descendants
+	s.BytesFreed += upd.FreedBytes
+}
+
+// addEntry counts the synced tar entry hdr by type, and its content as read.
+func (s *Summary) addEntry(hdr *tar.Header) {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		s.Files++
+		s.BytesRead += hdr.Size
+	case tar.TypeDir:
+		s.Dirs++
+	case tar.TypeSymlink:
+		s.Symlinks++
+	case tar.TypeLink:
+		s.HardLinks++
 	}
 }
 
 func (s Summary) String() string {
-	return fmt.Sprintf("added: %d updated: %d deleted: %d", s.Added, s.Updated, s.Deleted)
+	str := fmt.Sprintf("added: %d updated: %d deleted: %d", s.Added, s.Updated, s.Deleted)
+	if s.Replaced > 0 {
+		str += fmt.Sprintf(" replaced: %d", s.Replaced)
+	}
+	if s.Relabeled > 0 {
+		str += fmt.Sprintf(" relabeled: %d", s.Relabeled)
+	}
+	if s.Unchanged > 0 {
+		str += fmt.Sprintf(" unchanged: %d", s.Unchanged)
+	}
+	if s.Skipped > 0 {
+		str += fmt.Sprintf(" skipped: %d", s.Skipped)
+	}
+	if s.BytesWritten > 0 {
+		str += fmt.Sprintf(" written: %d", s.BytesWritten)
+	}
+	if s.BytesFreed > 0 {
+		str += fmt.Sprintf(" freed: %d", s.BytesFreed)
+	}
+	return str
 }
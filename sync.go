@@ -2,13 +2,16 @@ package aferosync
 
 import (
 	"archive/tar"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"syscall"
 	"time"
 
 	"github.com/spf13/afero"
@@ -22,21 +25,55 @@ type Sync struct {
 	symlinker  afero.Symlinker
 	lchowner   Lchowner
 	hardlinker Linker
+	xattrer    Xattrer
+
+	fileContexts fileContexts
 
 	pathMap     map[string]struct{}
 	deletePaths []string
 
-	baseDirPath    string
-	baseDirModTime time.Time
+	deferredDirs []deferredDir
+
+	dirModTimes map[string]time.Time
+
+	// baseDirPath is the directory touched last, see BaseDir
+	baseDirPath string
+
+	journal *journal
+	undo    *undo
+	events  *Encoder
+
+	// stage holds the changes of a dry run
+	stage *Stage
 
 	upd PathUpdate
 	err error
 
+	// pending holds the updates to report before continuing, the deleted descendants of removed
+	// directories
+	pending []PathUpdate
+
+	// orig is the file at the path of the current entry before it's synced, nil if it didn't exist
+	// or was replaced by a file of another type. Updates report changes against it.
+	orig *origFile
+
 	summary Summary
+
+	// start is the time of the first call to Next
+	start time.Time
 }
 
+// BaseDir returns the directory touched last and its original modtime, which is restored once the
+// sync completes. It returns an empty path if there's none.
+//
+// Deprecated: the modtimes of all touched directories are restored together at the end of the
+// sync rather than one base dir at a time.
 func (s *Sync) BaseDir() (string, time.Time) {
-	return s.baseDirPath, s.baseDirModTime
+	modTime, ok := s.dirModTimes[s.baseDirPath]
+	if !ok {
+		return "", time.Time{}
+	}
+	return s.baseDirPath, modTime
 }
 
 func New(fs afero.Fs, tarReader *tar.Reader, opts ...Option) *Sync {
@@ -49,6 +86,14 @@ func New(fs afero.Fs, tarReader *tar.Reader, opts ...Option) *Sync {
 		o(&ret.opts)
 	}
 
+	if ret.opts.undoWriter != nil {
+		ret.undo = newUndo(ret.opts.undoWriter)
+	}
+
+	if ret.opts.eventWriter != nil {
+		ret.events = NewEncoder(ret.opts.eventWriter)
+	}
+
 	if ret.opts.withSymlinks {
 		var ok bool
 		if ret.symlinker, ok = fs.(afero.Symlinker); !ok {
@@ -62,6 +107,14 @@ func New(fs afero.Fs, tarReader *tar.Reader, opts ...Option) *Sync {
 		}
 	}
 
+	if ret.opts.withXattrs || ret.opts.withSELinux {
+		var ok bool
+		if ret.xattrer, ok = fs.(Xattrer); !ok {
+			ret.err = fmt.Errorf("xattr syncing or selinux labeling is enabled but fs doesn't implement aferosync.Xattrer")
+			return &ret
+		}
+	}
+
 	var curFileInfo os.FileInfo
 	if ret.opts.withHardLinks || ret.opts.withOwnership {
 		var err error
@@ -91,6 +144,21 @@ func New(fs afero.Fs, tarReader *tar.Reader, opts ...Option) *Sync {
 		}
 	}
 
+	// the checks above are against fs, a dry run must fail where a real sync would
+	if ret.opts.withDryRun {
+		ret.stage = NewStage(fs)
+		ret.fs = ret.stage
+		if ret.symlinker != nil {
+			ret.symlinker, ret.lchowner = ret.stage, ret.stage
+		}
+		if ret.hardlinker != nil {
+			ret.hardlinker = ret.stage
+		}
+		if ret.xattrer != nil {
+			ret.xattrer = ret.stage
+		}
+	}
+
 	return &ret
 }
 
@@ -104,16 +172,77 @@ func (s *Sync) Run() ([]PathUpdate, error) {
 
 func (s *Sync) Next() bool {
 	if s.err != nil {
+		s.closeEvents()
 		return false
 	}
 
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	defer func() {
+		s.summary.Duration = time.Since(s.start)
+	}()
+
+	// keep the journal of a failed sync for resuming and what's been undone so far
+	defer func() {
+		if s.err != nil && s.journal != nil {
+			s.journal.close()
+			s.journal = nil
+		}
+		if s.err != nil && s.undo != nil {
+			s.closeUndo()
+		}
+		if s.err != nil {
+			s.closeEvents()
+		}
+	}()
+
 	if s.pathMap == nil {
-		var err error
-		s.pathMap, err = s.allPathsMap()
+		pathMap, err := s.allPathsMap()
 		if err != nil {
 			s.err = err
 			return false
 		}
+
+		if err := s.removeTempFiles(pathMap); err != nil {
+			s.err = err
+			return false
+		}
+
+		// additive syncs don't delete paths missing from the tar
+		s.pathMap = pathMap
+		if s.opts.withAdditive {
+			s.pathMap = map[string]struct{}{}
+		}
+
+		if s.opts.withJournal {
+			if err := s.openJournal(); err != nil {
+				s.err = err
+				return false
+			}
+		}
+	}
+
+	if s.opts.withSELinux && s.fileContexts == nil {
+		fsys := s.opts.selinuxFs
+		if fsys == nil {
+			fsys = s.fs
+		}
+
+		var err error
+		if s.fileContexts, err = loadFileContexts(fsys, s.opts.selinuxPath); err != nil {
+			s.err = fmt.Errorf("failed to load selinux file contexts: %w", err)
+			return false
+		}
+	}
+
+	if len(s.pending) > 0 {
+		s.upd, s.pending = s.pending[0], s.pending[1:]
+		if err := s.report(); err != nil {
+			s.err = err
+			return false
+		}
+		return true
 	}
 
 	// add and update files
@@ -130,47 +259,43 @@ func (s *Sync) Next() bool {
 		s.upd = PathUpdate{
 			Path: path,
 		}
+		s.orig = nil
 
-		switch hdr.Typeflag {
-		case tar.TypeReg:
-			if err := s.syncRegularFile(hdr); err != nil {
-				s.err = fmt.Errorf("failed to sync regular file: %s: %w", path, err)
-				return false
-			}
-		case tar.TypeDir:
-			if err := s.syncDir(hdr); err != nil {
-				s.err = fmt.Errorf("failed to sync dir: %s: %w", path, err)
-				return false
-			}
-		case tar.TypeSymlink:
-			if !s.opts.withSymlinks {
-				continue
-			}
+		if done, err := s.resumeEntry(hdr); err != nil {
+			s.err = err
+			return false
+		} else if done {
+			delete(s.pathMap, path)
+			continue
+		}
 
-			if err := s.syncSymlink(hdr); err != nil {
-				s.err = fmt.Errorf("failed to sync symlink: %s: %w", path, err)
-				return false
-			}
-		case tar.TypeLink:
-			if !s.opts.withHardLinks {
-				continue
-			}
+		if synced, err := s.syncEntry(hdr); err != nil {
+			s.err = err
+			return false
+		} else if !synced {
+			s.summary.Skipped++
+			continue
+		}
 
-			if err := s.syncLink(hdr); err != nil {
-				s.err = fmt.Errorf("failed to sync hard link: %s: %w", path, err)
+		delete(s.pathMap, path)
+
+		if s.journal != nil {
+			if err := s.journal.recordDone(hdr); err != nil {
+				s.err = err
 				return false
 			}
-		default:
-			s.err = fmt.Errorf("unexpected file type in tar: %s: %d", path, hdr.Typeflag)
-			return false
 		}
 
-		delete(s.pathMap, path)
+		if s.upd.IsEmpty() {
+			s.summary.Unchanged++
+			continue
+		}
 
-		if !s.upd.IsEmpty() {
-			s.summary.Add(s.upd.Update)
-			return true
+		if err := s.report(); err != nil {
+			s.err = err
+			return false
 		}
+		return true
 	}
 
 	// flatten s.pathMap
@@ -192,6 +317,16 @@ func (s *Sync) Next() bool {
 			continue
 		}
 
+		// paths under an ancestor that was replaced by a file or a symlink are already gone,
+		// resolving them would fail or follow the symlink and delete its target instead
+		if ok, err := s.ancestorsAreDirs(path); err != nil {
+			s.err = err
+			return false
+		} else if !ok {
+			s.deletePaths = s.deletePaths[1:]
+			continue
+		}
+
 		if _, _, err := LstatOrStat(s.fs, path); errors.Is(err, fs.ErrNotExist) {
 			// ignore paths that don't exist
 			// some paths appear in the guestfs.Guestfs.Filesystem_walk results but can't be
@@ -207,32 +342,98 @@ func (s *Sync) Next() bool {
 			continue
 		} else if err != nil {
 			s.err = fmt.Errorf("failed to stat: %s: %w", path, err)
+			return false
 		}
 
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
 			s.err = err
 			return false
 		}
 
-		if err := s.fs.RemoveAll(path); err != nil {
-			s.err = fmt.Errorf("failed to remove: %s: %w", path, err)
+		if err := s.undoSaveTree(path); err != nil {
+			s.err = err
 			return false
 		}
 
-		s.upd = PathUpdate{
-			Path: path,
-			Update: Update{
-				Deleted: true,
-			},
+		upd, err := s.removeAll(path)
+		if err != nil {
+			s.err = err
+			return false
+		}
+
+		s.upd = upd
+		if err := s.report(); err != nil {
+			s.err = err
+			return false
 		}
-		s.summary.Add(s.upd.Update)
 		return true
 	}
 
-	s.err = s.preserveBaseDir("")
+	if err := s.restoreDirModTimes(); err != nil {
+		s.err = err
+		return false
+	}
+
+	if err := s.applyDeferredDirs(); err != nil {
+		s.err = err
+		return false
+	}
+
+	if err := s.closeJournal(); err != nil {
+		s.err = err
+		return false
+	}
+
+	if s.opts.layerWriter != nil {
+		if err := s.stage.Layer(s.opts.layerWriter); err != nil {
+			s.err = fmt.Errorf("failed to write layer: %w", err)
+			return false
+		}
+	}
+
+	if err := s.closeUndo(); err != nil {
+		s.err = err
+		return false
+	}
+
+	s.closeEvents()
 	return false
 }
 
+// report counts the update in the summary and writes its event.
+func (s *Sync) report() error {
+	s.summary.Add(s.upd.Update)
+
+	if s.events != nil {
+		if err := s.events.EncodeUpdate(s.upd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeEvents ends the event stream with the summary, or with the error if the sync has failed.
+func (s *Sync) closeEvents() {
+	if s.events == nil {
+		return
+	}
+
+	events := s.events
+	s.events = nil
+
+	if s.err != nil {
+		// the sync error takes precedence
+		events.EncodeError(s.err)
+		return
+	}
+
+	if !s.start.IsZero() {
+		s.summary.Duration = time.Since(s.start)
+	}
+	s.err = events.EncodeSummary(s.summary)
+}
+
 func (s *Sync) Update() PathUpdate {
 	if s.err != nil {
 		return PathUpdate{}
@@ -249,6 +450,51 @@ func (s *Sync) Err() error {
 	return s.err
 }
 
+// syncEntry syncs the tar entry hdr. It returns false if the entry has been skipped.
+func (s *Sync) syncEntry(hdr *tar.Header) (bool, error) {
+	path := normalizePath(hdr.Name)
+
+	// whiteouts aren't entries of the synced tree, only the paths they delete are counted
+	if _, ok := whiteoutTarget(path); ok && s.opts.withAdditive {
+		if err := s.syncWhiteout(hdr); err != nil {
+			return false, fmt.Errorf("failed to sync whiteout: %s: %w", path, err)
+		}
+		return true, nil
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if err := s.syncRegularFile(hdr); err != nil {
+			return false, fmt.Errorf("failed to sync regular file: %s: %w", path, err)
+		}
+	case tar.TypeDir:
+		if err := s.syncDir(hdr); err != nil {
+			return false, fmt.Errorf("failed to sync dir: %s: %w", path, err)
+		}
+	case tar.TypeSymlink:
+		if !s.opts.withSymlinks {
+			return false, nil
+		}
+
+		if err := s.syncSymlink(hdr); err != nil {
+			return false, fmt.Errorf("failed to sync symlink: %s: %w", path, err)
+		}
+	case tar.TypeLink:
+		if !s.opts.withHardLinks {
+			return false, nil
+		}
+
+		if err := s.syncLink(hdr); err != nil {
+			return false, fmt.Errorf("failed to sync hard link: %s: %w", path, err)
+		}
+	default:
+		return false, fmt.Errorf("unexpected file type in tar: %s: %d", path, hdr.Typeflag)
+	}
+
+	s.summary.addEntry(hdr)
+	return true, nil
+}
+
 func (s *Sync) allPathsMap() (map[string]struct{}, error) {
 	paths, err := AllPaths(s.fs)
 	if err != nil {
@@ -270,29 +516,58 @@ func (s *Sync) syncRegularFile(hdr *tar.Header) error {
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to stat: %s: %w", path, err)
 	}
+	if fi == nil {
+		s.undoAdd(path)
+	}
 
 	if fi != nil && !fi.Mode().IsRegular() {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.replace(path, fi, 0); err != nil {
 			return err
 		}
-
-		if err = s.fs.RemoveAll(path); err != nil {
-			return fmt.Errorf("failed to remove: %s: %w", path, err)
-		}
 		fi = nil
 	}
+	s.orig = newOrigFile(fi)
 
 	if fi == nil || !(hdr.Size == fi.Size() && hdr.ModTime.Equal(fi.ModTime())) {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
 			return err
 		}
 
-		err := afero.WriteReader(s.fs, path, s.tarReader)
+		if err := s.undoSave(path); err != nil {
+			return err
+		}
+
+		if err := s.journalBegin(path); err != nil {
+			return err
+		}
+
+		r, err := s.diffContent(path, hdr, fi)
+		if err != nil {
+			return err
+		}
+
+		if s.opts.withAtomic {
+			if err := s.writeRegularFileAtomic(hdr, r); err != nil {
+				return err
+			}
+
+			s.setContentUpdate(hdr)
+			return nil
+		}
+
+		// writing in place would change the content of all other links to the same inode
+		if nlinker, ok := fi.(FileInfoNlinker); ok && nlinker.Nlink() > 1 {
+			if err := s.fs.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove hard link: %s: %w", path, err)
+			}
+		}
+
+		err = s.writeFile(path, r, hdr.Size)
 		if err != nil {
 			return fmt.Errorf("failed to write file: %s: %w", path, err)
 		}
 
-		s.upd.Added = true
+		s.setContentUpdate(hdr)
 		fi = nil
 	}
 
@@ -303,6 +578,207 @@ func (s *Sync) syncRegularFile(hdr *tar.Header) error {
 	return nil
 }
 
+// replace removes fi, the file at path, to replace it with a file of newType. The update reports
+// the replacement, and the descendants of a replaced directory are reported as deleted right after
+// it, before the next entry.
+func (s *Sync) replace(path string, fi fs.FileInfo, newType fs.FileMode) error {
+	if err := s.touchDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if err := s.undoSaveTree(path); err != nil {
+		return err
+	}
+
+	removed, err := s.removeAll(path)
+	if err != nil {
+		return err
+	}
+
+	s.upd.Replaced = true
+	s.upd.OldType = fi.Mode().Type()
+	s.upd.NewType = newType
+	s.upd.Descendants = removed.Descendants
+	s.upd.FreedBytes = removed.FreedBytes
+
+	return nil
+}
+
+// removeAll removes path and its descendants. It returns the update reporting path as deleted and
+// queues the updates of the descendants, unless they're rolled up into the returned one.
+func (s *Sync) removeAll(path string) (PathUpdate, error) {
+	removed := []PathUpdate{}
+
+	// a file's bytes are only freed with its last link, links are counted per inode
+	type inode struct {
+		first  int
+		links  int
+		nlinks int
+	}
+	inodes := map[int]*inode{}
+
+	err := afero.Walk(s.fs, path, func(walkPath string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk: %s: %w", walkPath, err)
+		}
+
+		upd := PathUpdate{
+			Path: walkPath,
+			Update: Update{
+				Deleted: true,
+				OldType: fi.Mode().Type(),
+			},
+		}
+
+		if fi.Mode().IsRegular() {
+			upd.OldSize = ptr(fi.Size())
+			upd.FreedBytes = fi.Size()
+
+			inoer, ok1 := fi.(FileInfoInoer)
+			nlinker, ok2 := fi.(FileInfoNlinker)
+			if ok1 && ok2 && nlinker.Nlink() > 1 {
+				ino, ok := inodes[inoer.Ino()]
+				if !ok {
+					ino = &inode{first: len(removed), nlinks: nlinker.Nlink()}
+					inodes[inoer.Ino()] = ino
+				}
+				ino.links++
+				upd.FreedBytes = 0
+			}
+		}
+
+		removed = append(removed, upd)
+		delete(s.pathMap, walkPath)
+		return nil
+	})
+	if err != nil {
+		return PathUpdate{}, err
+	}
+
+	for _, ino := range inodes {
+		if ino.links >= ino.nlinks {
+			removed[ino.first].FreedBytes = *removed[ino.first].OldSize
+		}
+	}
+
+	if err := s.fs.RemoveAll(path); err != nil {
+		return PathUpdate{}, fmt.Errorf("failed to remove: %s: %w", path, err)
+	}
+	s.untouchDir(path)
+
+	upd, descendants := removed[0], removed[1:]
+	if s.opts.withDeleteRollup {
+		upd.Descendants = len(descendants)
+		for _, desc := range descendants {
+			upd.FreedBytes += desc.FreedBytes
+		}
+	} else {
+		s.pending = append(s.pending, descendants...)
+	}
+
+	return upd, nil
+}
+
+// setAdded records that the file of the entry has been created, unless it replaced another one.
+func (s *Sync) setAdded() {
+	if !s.upd.Replaced {
+		s.upd.Added = true
+	}
+}
+
+// origFile is a snapshot of a file's metadata. The FileInfos of some filesystems reflect later
+// changes.
+type origFile struct {
+	mode     fs.FileMode
+	uid, gid int
+	modTime  time.Time
+	size     int64
+}
+
+// newOrigFile returns a snapshot of fi, or nil if fi is nil.
+func newOrigFile(fi fs.FileInfo) *origFile {
+	if fi == nil {
+		return nil
+	}
+
+	// in the location of tar modtimes, some filesystems report them in UTC
+	orig := &origFile{
+		mode:    fi.Mode(),
+		modTime: fi.ModTime().Local(),
+		size:    fi.Size(),
+	}
+	if owner, ok := fi.(FileInfoOwner); ok {
+		orig.uid, orig.gid = owner.Uid(), owner.Gid()
+	}
+
+	return orig
+}
+
+// setContentUpdate records that the content of hdr's file has been written, which adds it unless it
+// existed before.
+func (s *Sync) setContentUpdate(hdr *tar.Header) {
+	// a dry run only writes to its stage
+	if s.stage == nil {
+		s.summary.BytesWritten += hdr.Size
+	}
+
+	s.upd.Size = ptr(hdr.Size)
+	if s.orig == nil {
+		s.setAdded()
+		return
+	}
+
+	s.upd.ContentChanged = true
+	s.upd.OldSize = ptr(s.orig.size)
+}
+
+// diffContent sets the content diff of the update if enabled and both the current content of path
+// and hdr's content look like text. It returns the reader of hdr's content.
+func (s *Sync) diffContent(path string, hdr *tar.Header, fi fs.FileInfo) (io.Reader, error) {
+	maxSize := s.opts.contentDiffMaxSize
+	if maxSize <= 0 || fi == nil || fi.Size() > maxSize || hdr.Size > maxSize {
+		return s.tarReader, nil
+	}
+
+	newContent, err := io.ReadAll(s.tarReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file from tar: %s: %w", path, err)
+	}
+
+	oldContent, err := afero.ReadFile(s.fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %s: %w", path, err)
+	}
+
+	if looksLikeText(oldContent) && looksLikeText(newContent) {
+		s.upd.Diff = contentDiff(filepath.ToSlash(path), oldContent, newContent)
+	}
+
+	return bytes.NewReader(newContent), nil
+}
+
+func (s *Sync) writeFile(path string, r io.Reader, size int64) error {
+	if !s.opts.withSparse {
+		return afero.WriteReader(s.fs, path, r)
+	}
+
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	f, err := s.fs.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSparse(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
 func (s *Sync) syncDir(hdr *tar.Header) error {
 	path := normalizePath(hdr.Name)
 	tarFileInfo := hdr.FileInfo()
@@ -311,29 +787,34 @@ func (s *Sync) syncDir(hdr *tar.Header) error {
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to stat: %s: %w", path, err)
 	}
+	if fi == nil {
+		s.undoAdd(path)
+	}
 
 	if fi != nil && fi.Mode().Type() != fs.ModeDir {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.replace(path, fi, fs.ModeDir); err != nil {
 			return err
 		}
-
-		if err := s.fs.Remove(path); err != nil {
-			return fmt.Errorf("failed to remove: %s: %w", path, err)
-		}
 		fi = nil
 	}
+	s.orig = newOrigFile(fi)
 
 	if fi == nil {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
 			return err
 		}
 
-		err := s.fs.Mkdir(path, tarFileInfo.Mode().Perm())
+		perm := tarFileInfo.Mode().Perm()
+		if s.opts.withDeferredDirs {
+			perm |= 0700
+		}
+
+		err := s.fs.Mkdir(path, perm)
 		if err != nil {
 			return fmt.Errorf("failed to make file: %s: %w", path, err)
 		}
 
-		s.upd.Added = true
+		s.setAdded()
 		s.upd.Mode = ptr(tarFileInfo.Mode().Perm() | fs.ModeDir)
 	}
 
@@ -341,6 +822,18 @@ func (s *Sync) syncDir(hdr *tar.Header) error {
 		return fmt.Errorf("failed to sync stat: %w", err)
 	}
 
+	if s.opts.withDeferredDirs {
+		if err := s.makeDirWritable(path); err != nil {
+			return err
+		}
+
+		s.deferredDirs = append(s.deferredDirs, deferredDir{
+			path:    path,
+			mode:    tarFileInfo.Mode(),
+			modTime: hdr.ModTime,
+		})
+	}
+
 	return nil
 }
 
@@ -351,17 +844,18 @@ func (s *Sync) syncSymlink(hdr *tar.Header) error {
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to lstat: %s: %w", path, err)
 	}
+	if fi == nil {
+		s.undoAdd(path)
+	}
 
 	// remove if not symlink
 	if fi != nil && fi.Mode().Type() != fs.ModeSymlink {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.replace(path, fi, fs.ModeSymlink); err != nil {
 			return err
 		}
-		if err := s.fs.RemoveAll(path); err != nil {
-			return fmt.Errorf("failed to remove: %s: %w", path, err)
-		}
 		fi = nil
 	}
+	s.orig = newOrigFile(fi)
 
 	// remove if symlink but target differs
 	if fi != nil {
@@ -371,7 +865,12 @@ func (s *Sync) syncSymlink(hdr *tar.Header) error {
 		}
 
 		if target != hdr.Linkname {
-			if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+			s.upd.OldLink = ptr(target)
+
+			if err := s.touchDir(filepath.Dir(path)); err != nil {
+				return err
+			}
+			if err := s.undoSave(path); err != nil {
 				return err
 			}
 			err = s.fs.Remove(path)
@@ -384,7 +883,7 @@ func (s *Sync) syncSymlink(hdr *tar.Header) error {
 
 	// add if doesn't exist
 	if fi == nil {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
 			return err
 		}
 
@@ -393,7 +892,9 @@ func (s *Sync) syncSymlink(hdr *tar.Header) error {
 			return fmt.Errorf("failed to make link: %s: %w", path, err)
 		}
 
-		s.upd.Added = true
+		if s.orig == nil {
+			s.setAdded()
+		}
 		s.upd.Link = ptr(hdr.Linkname)
 		fi = nil
 	}
@@ -413,6 +914,9 @@ func (s *Sync) syncLink(hdr *tar.Header) error {
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to stat: %s: %w", path, err)
 	}
+	if fi == nil {
+		s.undoAdd(path)
+	}
 
 	fileInDisk := fi != nil
 
@@ -422,21 +926,43 @@ func (s *Sync) syncLink(hdr *tar.Header) error {
 			return fmt.Errorf("failed to stat link target: %s: %w", path, err)
 		}
 
-		if fi.(FileInfoInoer).Ino() != targetFileInfo.(FileInfoInoer).Ino() {
-			if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if fi.Mode().Type() != targetFileInfo.Mode().Type() {
+			if err := s.replace(path, fi, targetFileInfo.Mode().Type()); err != nil {
+				return err
+			}
+
+			fileInDisk = false
+		} else if fi.(FileInfoInoer).Ino() != targetFileInfo.(FileInfoInoer).Ino() {
+			// the path now links to other content, report it as changed against the old file
+			s.orig = newOrigFile(fi)
+			if fi.Mode().IsRegular() {
+				s.upd.ContentChanged = true
+				s.upd.Size = ptr(targetFileInfo.Size())
+				s.upd.OldSize = ptr(s.orig.size)
+			}
+
+			if err := s.touchDir(filepath.Dir(path)); err != nil {
+				return err
+			}
+
+			if err := s.undoSaveTree(path); err != nil {
 				return err
 			}
 
 			if err = s.fs.RemoveAll(path); err != nil {
 				return fmt.Errorf("failed to remove link: %s: %w", path, err)
 			}
+			s.untouchDir(path)
 
 			fileInDisk = false
 		}
 	}
+	if fileInDisk {
+		s.orig = newOrigFile(fi)
+	}
 
 	if !fileInDisk {
-		if err := s.preserveBaseDir(filepath.Dir(path)); err != nil {
+		if err := s.touchDir(filepath.Dir(path)); err != nil {
 			return err
 		}
 
@@ -444,7 +970,9 @@ func (s *Sync) syncLink(hdr *tar.Header) error {
 			return fmt.Errorf("failed to make link: %s: %w", path, err)
 		}
 
-		s.upd.Added = true
+		if s.orig == nil {
+			s.setAdded()
+		}
 		fi = nil
 	}
 
@@ -456,8 +984,16 @@ func (s *Sync) syncLink(hdr *tar.Header) error {
 }
 
 func (s *Sync) syncStat(hdr *tar.Header, fi fs.FileInfo) error {
-	path := normalizePath(hdr.Name)
+	return s.syncStatAt(normalizePath(hdr.Name), hdr, fi)
+}
+
+// syncStatAt syncs the metadata of the file at path, which is hdr's file or its temp file, to hdr.
+func (s *Sync) syncStatAt(path string, hdr *tar.Header, fi fs.FileInfo) error {
+	name := normalizePath(hdr.Name)
 	tarFileInfo := hdr.FileInfo()
+	undoSave := func() error {
+		return s.undoSave(name)
+	}
 
 	if fi == nil {
 		var err error
@@ -467,9 +1003,15 @@ func (s *Sync) syncStat(hdr *tar.Header, fi fs.FileInfo) error {
 		}
 	}
 
+	// changes are reported against s.orig, which differs from fi if the file has been rewritten
 	if s.opts.withOwnership {
 		statOwner := fi.(FileInfoOwner)
-		if hdr.Uid != statOwner.Uid() || hdr.Gid != statOwner.Gid() {
+		changed := hdr.Uid != statOwner.Uid() || hdr.Gid != statOwner.Gid()
+		if changed {
+			if err := undoSave(); err != nil {
+				return err
+			}
+
 			var err error
 			if hdr.Typeflag == tar.TypeSymlink {
 				err = s.lchowner.Lchown(path, hdr.Uid, hdr.Gid)
@@ -480,64 +1022,141 @@ func (s *Sync) syncStat(hdr *tar.Header, fi fs.FileInfo) error {
 				return fmt.Errorf("failed to chown: %s: %w", path, err)
 			}
 
-			s.upd.Uid = ptr(hdr.Uid)
-			s.upd.Gid = ptr(hdr.Gid)
-
 			fi, _, err = LstatOrStat(s.fs, path)
 			if err != nil {
 				return fmt.Errorf("failed to stat: %s: %w", path, err)
 			}
 		}
+
+		if s.orig != nil {
+			changed = hdr.Uid != s.orig.uid || hdr.Gid != s.orig.gid
+			if changed {
+				s.upd.OldUid = ptr(s.orig.uid)
+				s.upd.OldGid = ptr(s.orig.gid)
+			}
+		}
+
+		if changed {
+			s.upd.Uid = ptr(hdr.Uid)
+			s.upd.Gid = ptr(hdr.Gid)
+		}
 	}
 
+	// deferred directory modes and modtimes are applied by applyDeferredDirs
+	deferred := s.opts.withDeferredDirs && hdr.Typeflag == tar.TypeDir
+
 	// symlink mode permissions are not typically read, safest to ignore
-	if hdr.Typeflag != tar.TypeSymlink && tarFileInfo.Mode() != fi.Mode() {
-		err := s.fs.Chmod(path, tarFileInfo.Mode())
-		if err != nil {
-			return fmt.Errorf("failed to chmod: %s: %w", path, err)
+	if hdr.Typeflag != tar.TypeSymlink {
+		changed := tarFileInfo.Mode() != fi.Mode()
+		if changed {
+			if err := undoSave(); err != nil {
+				return err
+			}
+
+			if !deferred {
+				err := s.fs.Chmod(path, tarFileInfo.Mode())
+				if err != nil {
+					return fmt.Errorf("failed to chmod: %s: %w", path, err)
+				}
+			}
+		}
+
+		if s.orig != nil {
+			changed = tarFileInfo.Mode() != s.orig.mode
+			if changed {
+				s.upd.OldMode = ptr(s.orig.mode)
+			}
 		}
 
-		s.upd.Mode = ptr(tarFileInfo.Mode())
+		if changed {
+			s.upd.Mode = ptr(tarFileInfo.Mode())
+		}
 	}
 
-	if !hdr.ModTime.Equal(fi.ModTime()) {
-		err := s.fs.Chtimes(path, hdr.ModTime, hdr.ModTime)
+	// hard links share their xattrs with the target, which is synced on its own
+	if (s.opts.withXattrs || s.opts.withSELinux) && hdr.Typeflag != tar.TypeLink {
+		want := map[string]string{}
+		if s.opts.withXattrs {
+			want = tarXattrs(hdr)
+		}
+
+		relabel := false
+		if s.opts.withSELinux {
+			if label, ok := s.fileContexts.Lookup(name, tarFileInfo.Mode()); ok {
+				want[selinuxXattr] = label + "\x00"
+				relabel = true
+			}
+		}
+
+		changed, err := syncXattrs(s.xattrer, path, hdr.Typeflag == tar.TypeSymlink, want, s.opts.withXattrs, undoSave)
 		if err != nil {
-			return fmt.Errorf("failed to chtimes: %s: %w", path, err)
+			return err
 		}
 
+		s.upd.Xattrs = changed
+
+		// labels copied from the tar's xattrs aren't relabels
+		if relabel && slices.Contains(changed, selinuxXattr) {
+			s.summary.Relabeled++
+		}
+	}
+
+	changed := !hdr.ModTime.Equal(fi.ModTime())
+	if changed {
+		if err := undoSave(); err != nil {
+			return err
+		}
+
+		if !deferred {
+			err := s.fs.Chtimes(path, hdr.ModTime, hdr.ModTime)
+			if err != nil {
+				return fmt.Errorf("failed to chtimes: %s: %w", path, err)
+			}
+
+			// restore the new modtime if the dir has been touched before
+			if _, ok := s.dirModTimes[path]; ok {
+				s.dirModTimes[path] = hdr.ModTime
+			}
+		}
+	}
+
+	if s.orig != nil {
+		changed = !hdr.ModTime.Equal(s.orig.modTime)
+		if changed {
+			s.upd.OldModTime = ptr(s.orig.modTime)
+		}
+	}
+
+	if changed {
 		s.upd.ModTime = ptr(hdr.ModTime)
 	}
 
 	return nil
 }
 
-func (s *Sync) preserveBaseDir(baseDirPath string) error {
-	// only execute when baseDirPath changes to save calls to guestfs
-	if baseDirPath == s.baseDirPath {
-		return nil
+// ancestorsAreDirs reports whether all ancestors of path are directories and not symlinks to them.
+func (s *Sync) ancestorsAreDirs(path string) (bool, error) {
+	dirs := []string{}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
 	}
 
-	// restore last base's modtime
-	if s.baseDirPath != "" {
-		if err := s.fs.Chtimes(s.baseDirPath, s.baseDirModTime, s.baseDirModTime); err != nil {
-			return fmt.Errorf("failed to preserve base dir modtime: %s: %w", s.baseDirPath, err)
+	// shallowest first, so that no symlinks are followed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		fi, _, err := LstatOrStat(s.fs, dir)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("failed to stat: %s: %w", dir, err)
 		}
-		s.baseDirPath = ""
-	}
 
-	// store this base's modtime
-	if baseDirPath != "" {
-		fi, _, err := LstatOrStat(s.fs, baseDirPath)
-		if err != nil {
-			return fmt.Errorf("failed to stat base dir: %s: %w", baseDirPath, err)
+		if !fi.IsDir() {
+			return false, nil
 		}
-
-		s.baseDirPath = baseDirPath
-		s.baseDirModTime = fi.ModTime()
 	}
 
-	return nil
+	return true, nil
 }
 
 func normalizePath(path string) string {
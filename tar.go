@@ -2,7 +2,14 @@ package aferosync
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/spf13/afero"
 )
@@ -11,13 +18,184 @@ type TarOuter interface {
 	TarOut(dir string, w io.Writer) error
 }
 
-// WriteTar calls fs.WriteTar if implemented or falls back to tar.Writer.AddFS.
-func TarOut(fsys afero.Fs, dir string, w io.Writer) error {
-	if tw, ok := fsys.(TarOuter); ok {
+type tarOptions struct {
+	withReproducible bool
+	withOwnerNames   bool
+	maxModTime       time.Time
+
+	// withoutRoot leaves out the entry of dir itself
+	withoutRoot bool
+}
+
+type TarOption func(opts *tarOptions)
+
+// WithTarReproducible makes TarOut write the archive itself even if fsys implements TarOuter, so
+// that the same tree always produces the same bytes.
+func WithTarReproducible(v bool) TarOption {
+	return func(opts *tarOptions) {
+		opts.withReproducible = v
+	}
+}
+
+// WithTarOwnerNames includes user and group names if fsys reports them. They're omitted by
+// default, they depend on the user database of the host rather than the tree.
+func WithTarOwnerNames(v bool) TarOption {
+	return func(opts *tarOptions) {
+		opts.withOwnerNames = v
+	}
+}
+
+// WithTarMaxModTime clamps modtimes later than t to t, like SOURCE_DATE_EPOCH. The zero time
+// disables clamping.
+func WithTarMaxModTime(t time.Time) TarOption {
+	return func(opts *tarOptions) {
+		opts.maxModTime = t
+	}
+}
+
+// TarOut calls fs.TarOut if implemented or falls back to walking dir. The fallback writes a PAX
+// archive with names relative to dir in lexical order, symlinks, ownership, exact modtimes and
+// extended attributes if fsys supports them, and zeroed access and change times. Regular files
+// sharing an inode are written as hard links to their lexically first path if their FileInfo
+// implements FileInfoInoer. The fallback output only depends on the tree and opts.
+func TarOut(fsys afero.Fs, dir string, w io.Writer, opts ...TarOption) error {
+	o := tarOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if tw, ok := fsys.(TarOuter); ok && !o.withReproducible {
 		return tw.TarOut(dir, w)
 	}
 
+	return tarOut(fsys, dir, w, o)
+}
+
+// TarOutDigest writes a reproducible archive of dir to w and returns its digest in the
+// "sha256:<hex>" form.
+func TarOutDigest(fsys afero.Fs, dir string, w io.Writer, opts ...TarOption) (string, error) {
+	h := sha256.New()
+	if err := TarOut(fsys, dir, io.MultiWriter(w, h), append(opts, WithTarReproducible(true))...); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func tarOut(fsys afero.Fs, dir string, w io.Writer, opts tarOptions) error {
 	tw := tar.NewWriter(w)
-	defer tw.Close()
-	return tw.AddFS(afero.NewIOFS(fsys))
+	if err := writeTree(tw, fsys, dir, opts); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %w", err)
+	}
+
+	return nil
+}
+
+// writeTree writes the tree at dir to tw in lexical order.
+func writeTree(tw *tar.Writer, fsys afero.Fs, dir string, opts tarOptions) error {
+	type entry struct {
+		path string
+		name string
+		fi   fs.FileInfo
+	}
+
+	entries := []entry{}
+	err := afero.Walk(fsys, dir, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk: %s: %w", path, err)
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return fmt.Errorf("failed to make relative path: %s: %w", path, err)
+		}
+
+		name := "./" + filepath.ToSlash(rel)
+		if rel == "." {
+			if opts.withoutRoot {
+				return nil
+			}
+			name = "./"
+		} else if fi.IsDir() {
+			name += "/"
+		}
+
+		entries = append(entries, entry{path: path, name: name, fi: fi})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a parent sorts before its children, and hard link leaders before their links
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	leaders := map[int]string{}
+
+	for _, e := range entries {
+		hdr, err := fileHeader(fsys, e.path, e.fi)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = e.name
+		hdr.Format = tar.FormatPAX
+
+		if opts.withOwnerNames {
+			// tar.FileInfoHeader looks the names up, fileHeader drops them
+			names, err := tar.FileInfoHeader(e.fi, "")
+			if err != nil {
+				return fmt.Errorf("failed to make header: %s: %w", e.path, err)
+			}
+			hdr.Uname, hdr.Gname = names.Uname, names.Gname
+		}
+
+		if !opts.maxModTime.IsZero() && hdr.ModTime.After(opts.maxModTime) {
+			hdr.ModTime = opts.maxModTime
+		}
+
+		if inoer, ok := e.fi.(FileInfoInoer); ok && e.fi.Mode().IsRegular() {
+			if nlinker, ok := e.fi.(FileInfoNlinker); !ok || nlinker.Nlink() > 1 {
+				if leader, ok := leaders[inoer.Ino()]; ok {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = leader
+					hdr.Size = 0
+				} else {
+					leaders[inoer.Ino()] = hdr.Name
+				}
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write header: %s: %w", e.path, err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyFile(tw, fsys, e.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyFile(w io.Writer, fsys afero.Fs, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open: %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to write file: %s: %w", path, err)
+	}
+
+	return nil
 }
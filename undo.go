@@ -0,0 +1,205 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// undo writes everything a sync overwrites or deletes to a tar, followed by whiteouts for the
+// paths it adds. Syncing the undo archive in additive mode rolls the sync back.
+type undo struct {
+	tw     *tar.Writer
+	saved  map[string]struct{}
+	added  map[string]struct{}
+	inodes map[int]string
+}
+
+func newUndo(w io.Writer) *undo {
+	return &undo{
+		tw:     tar.NewWriter(w),
+		saved:  map[string]struct{}{},
+		added:  map[string]struct{}{},
+		inodes: map[int]string{},
+	}
+}
+
+// undoAdd records that path didn't exist before the sync.
+func (s *Sync) undoAdd(path string) {
+	if s.undo == nil {
+		return
+	}
+
+	if _, ok := s.undo.saved[path]; !ok {
+		s.undo.added[path] = struct{}{}
+	}
+}
+
+// undoSave writes the current content and metadata of path to the undo archive before it's
+// modified. Paths that have been saved already or that have been added by the sync are ignored.
+func (s *Sync) undoSave(path string) error {
+	if s.undo == nil {
+		return nil
+	}
+	if _, ok := s.undo.saved[path]; ok {
+		return nil
+	}
+	if _, ok := s.undo.added[path]; ok {
+		return nil
+	}
+
+	fi, _, err := LstatOrStat(s.fs, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", path, err)
+	}
+
+	return s.undoSaveFile(path, fi)
+}
+
+// undoSaveTree is like undoSave but also saves all descendants of path before it's removed.
+func (s *Sync) undoSaveTree(path string) error {
+	if s.undo == nil {
+		return nil
+	}
+
+	fi, _, err := LstatOrStat(s.fs, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", path, err)
+	}
+
+	if err := s.undoSaveFile(path, fi); err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	names, err := readDirNames(s.fs, path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.undoSaveTree(filepath.Join(path, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Sync) undoSaveFile(path string, fi fs.FileInfo) error {
+	if _, ok := s.undo.saved[path]; ok {
+		return nil
+	}
+	if _, ok := s.undo.added[path]; ok {
+		return nil
+	}
+	s.undo.saved[path] = struct{}{}
+
+	hdr, err := fileHeader(s.fs, path, fi)
+	if err != nil {
+		return fmt.Errorf("failed to save undo: %w", err)
+	}
+
+	// children may have modified the dir already
+	if modTime, ok := s.dirModTimes[path]; ok && fi.IsDir() {
+		hdr.ModTime = modTime
+	}
+
+	if inoer, ok := fi.(FileInfoInoer); ok && fi.Mode().IsRegular() {
+		if target, ok := s.undo.inodes[inoer.Ino()]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target
+			hdr.Size = 0
+		} else {
+			s.undo.inodes[inoer.Ino()] = path
+		}
+	}
+
+	if err := s.undo.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write undo header: %s: %w", path, err)
+	}
+
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := s.fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open: %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(s.undo.tw, f); err != nil {
+		return fmt.Errorf("failed to write undo content: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// closeUndo writes whiteouts for the added paths and closes the undo archive. Descendants of
+// added paths are removed together with them, so they don't need whiteouts of their own.
+func (s *Sync) closeUndo() error {
+	if s.undo == nil {
+		return nil
+	}
+
+	added := make([]string, 0, len(s.undo.added))
+	for path := range s.undo.added {
+		added = append(added, path)
+	}
+	sort.Strings(added)
+
+	var last string
+	for _, path := range added {
+		if last != "" && strings.HasPrefix(path, last+"/") {
+			continue
+		}
+		last = path
+
+		if err := s.undo.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     whiteoutPath(path),
+			Mode:     0644,
+		}); err != nil {
+			return fmt.Errorf("failed to write whiteout: %s: %w", path, err)
+		}
+	}
+
+	tw := s.undo.tw
+	s.undo = nil
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close undo archive: %w", err)
+	}
+
+	return nil
+}
+
+func readDirNames(fsys afero.Fs, path string) ([]string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dir: %s: %w", path, err)
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dir names: %s: %w", path, err)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
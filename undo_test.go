@@ -0,0 +1,136 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUndo(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	t.Run("Undo", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build tars
+		before, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:     "./del/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(fs.ModePerm),
+				ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, {
+			Header: tar.Header{
+				Name:    "./del/test.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./keep.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./mod.txt",
+				Mode:    0644,
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text1",
+		}})
+		require.Nil(t, err)
+
+		after, err := aferosynctest.NewTar([]struct {
+			Header tar.Header
+			Body   string
+		}{{
+			Header: tar.Header{
+				Name:    "./add.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./keep.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text",
+		}, {
+			Header: tar.Header{
+				Name:    "./mod.txt",
+				Mode:    int64(fs.ModePerm),
+				ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+			Body: "some text2",
+		}})
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("del", fs.ModePerm)
+		require.Nil(t, err)
+		err = afs.Chmod("del", fs.ModeDir|fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "del/test.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "keep.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "mod.txt", []byte("some text1"), 0644)
+		require.Nil(t, err)
+		for _, name := range []string{"del/test.txt", "keep.txt", "mod.txt", "del"} {
+			err = afs.Chtimes(name, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			require.Nil(t, err)
+		}
+		aferosynctest.AssertEqualTars(t, before, afs)
+
+		// sync
+		undo := bytes.NewBuffer(nil)
+		_, err = aferosync.New(afs, tar.NewReader(bytes.NewBuffer(after)), append(opts, aferosync.WithUndo(undo))...).Run()
+		require.Nil(t, err)
+		aferosynctest.AssertEqualTars(t, after, afs)
+
+		undoFiles, err := aferosynctest.ReadTar(undo.Bytes())
+		require.Nil(t, err)
+		var undoNames []string
+		for _, f := range undoFiles {
+			undoNames = append(undoNames, filepath.Clean(f.Header.Name))
+		}
+		assert.Equal(t, []string{"mod.txt", "del", "del/test.txt", ".wh.add.txt"}, undoNames)
+
+		// roll back
+		var updates []aferosync.PathUpdate
+		sync := aferosync.New(afs, tar.NewReader(undo), append(opts, aferosync.WithAdditive(true))...)
+		for sync.Next() {
+			updates = append(updates, sync.Update())
+		}
+		require.Nil(t, sync.Err())
+
+		// assert
+		assert.Equal(t, aferosync.PathUpdate{
+			Path: "add.txt",
+			Update: aferosync.Update{
+				Deleted:    true,
+				OldSize:    ptr(int64(9)),
+				FreedBytes: 9,
+			},
+		}, updates[len(updates)-1])
+
+		aferosynctest.AssertEqualTars(t, before, afs)
+	})
+}
@@ -3,6 +3,8 @@ package aferosync
 import (
 	"fmt"
 	"io/fs"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -12,18 +14,51 @@ type PathUpdate struct {
 	Update
 }
 
+// Update describes the changes made to a path. The new values of changed attributes are set, along
+// with their old values unless the path has been added or replaced. Deleted paths have their
+// OldType set, and OldSize too if they're regular files.
 type Update struct {
 	Added   bool
 	Deleted bool
+
+	// Replaced is set if a file of another type has been removed to add the path, OldType and
+	// NewType are the fs.ModeType bits of the old and the new file then
+	Replaced bool
+	OldType  fs.FileMode
+	NewType  fs.FileMode
+
 	Mode    *fs.FileMode
 	Uid     *int
 	Gid     *int
 	ModTime *time.Time
 	Link    *string
+	Xattrs  []string
+
+	OldMode    *fs.FileMode
+	OldUid     *int
+	OldGid     *int
+	OldModTime *time.Time
+	OldLink    *string
+
+	// ContentChanged is set if the content of an existing regular file has been rewritten or a hard
+	// link now links to another file, OldSize is its old size then. Size is the new size of an
+	// added or changed regular file.
+	ContentChanged bool
+	Size           *int64
+	OldSize        *int64
+
+	// Descendants is the number of paths under a deleted or replaced directory that have been
+	// removed with it if they're rolled up into this update, see WithDeleteRollup. FreedBytes is the
+	// total size of the regular files whose last link has been removed, including the rolled up ones.
+	Descendants int
+	FreedBytes  int64
+
+	// Diff is a unified diff of the content of a rewritten text file, see WithContentDiff
+	Diff string
 }
 
 func (upd Update) IsEmpty() bool {
-	return upd == Update{}
+	return reflect.DeepEqual(upd, Update{})
 }
 
 func (upd PathUpdate) String() string {
@@ -33,25 +68,128 @@ func (upd PathUpdate) String() string {
 		} else {
 			return "added " + upd.Path
 		}
-	} else if upd.Deleted {
-		return fmt.Sprintf("deleted %s", upd.Path)
 	}
 
-	parts := make([]string, 0, 6)
-	parts = append(parts, "updated", upd.Path)
+	parts := make([]string, 0, 10)
+	if upd.Deleted {
+		parts = append(parts, "deleted", upd.Path, "type="+typeName(upd.OldType))
+		if upd.OldSize != nil {
+			parts = append(parts, fmt.Sprintf("size=%d", *upd.OldSize))
+		}
+	} else if upd.Replaced {
+		parts = append(parts, "replaced", upd.Path, "type="+typeName(upd.OldType)+"->"+typeName(upd.NewType))
+	} else {
+		parts = append(parts, "updated", upd.Path)
+	}
+
+	if upd.Descendants > 0 {
+		parts = append(parts, fmt.Sprintf("descendants=%d", upd.Descendants), fmt.Sprintf("freed=%d", upd.FreedBytes))
+	}
 
+	if upd.ContentChanged {
+		parts = append(parts, "content")
+	}
+	if upd.Size != nil {
+		parts = append(parts, "size="+change(upd.OldSize, upd.Size, func(v int64) string {
+			return fmt.Sprintf("%d", v)
+		}))
+	}
+	if upd.Link != nil {
+		parts = append(parts, "link="+change(upd.OldLink, upd.Link, func(v string) string {
+			return v
+		}))
+	}
 	if upd.Mode != nil {
-		parts = append(parts, fmt.Sprintf("mode=%s", upd.Mode.String()))
+		parts = append(parts, "mode="+change(upd.OldMode, upd.Mode, octalMode))
 	}
 	if upd.Uid != nil {
-		parts = append(parts, fmt.Sprintf("uid=%d", *upd.Uid))
+		parts = append(parts, "uid="+change(upd.OldUid, upd.Uid, func(v int) string {
+			return fmt.Sprintf("%d", v)
+		}))
 	}
 	if upd.Gid != nil {
-		parts = append(parts, fmt.Sprintf("gid=%d", *upd.Gid))
+		parts = append(parts, "gid="+change(upd.OldGid, upd.Gid, func(v int) string {
+			return fmt.Sprintf("%d", v)
+		}))
 	}
 	if upd.ModTime != nil {
-		parts = append(parts, fmt.Sprintf("modtime=%s", upd.ModTime.String()))
+		parts = append(parts, "modtime="+change(upd.OldModTime, upd.ModTime, time.Time.String))
+	}
+	if len(upd.Xattrs) > 0 {
+		parts = append(parts, fmt.Sprintf("xattrs=%s", strings.Join(upd.Xattrs, ",")))
 	}
 
 	return strings.Join(parts, " ")
 }
+
+// change formats a new value, preceded by the old one if it's known.
+func change[T any](old, new *T, format func(T) string) string {
+	if old == nil {
+		return format(*new)
+	}
+	return format(*old) + "->" + format(*new)
+}
+
+// typeNames names the file types.
+var typeNames = map[fs.FileMode]string{
+	0:                                 "file",
+	fs.ModeDir:                        "dir",
+	fs.ModeSymlink:                    "symlink",
+	fs.ModeNamedPipe:                  "pipe",
+	fs.ModeSocket:                     "socket",
+	fs.ModeDevice:                     "device",
+	fs.ModeDevice | fs.ModeCharDevice: "chardevice",
+}
+
+// typeName names the file type of mode.
+func typeName(mode fs.FileMode) string {
+	if name, ok := typeNames[mode.Type()]; ok {
+		return name
+	}
+	return mode.Type().String()
+}
+
+// parseTypeName returns the file type named by typeName.
+func parseTypeName(name string) (fs.FileMode, error) {
+	for typ, typName := range typeNames {
+		if typName == name {
+			return typ, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown file type: %s", name)
+}
+
+// octalMode formats the permission and special bits of mode like chmod, e.g. 0644.
+func octalMode(mode fs.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// parseOctalMode parses the permission and special bits formatted by octalMode.
+func parseOctalMode(str string) (fs.FileMode, error) {
+	bits, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || bits&^07777 != 0 {
+		return 0, fmt.Errorf("invalid mode: %s", str)
+	}
+
+	mode := fs.FileMode(bits).Perm()
+	if bits&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode, nil
+}
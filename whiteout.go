@@ -0,0 +1,59 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+func whiteoutPath(path string) string {
+	return filepath.Join(filepath.Dir(path), whiteoutPrefix+filepath.Base(path))
+}
+
+// whiteoutTarget returns the path removed by the whiteout at path.
+func whiteoutTarget(path string) (string, bool) {
+	base, ok := strings.CutPrefix(filepath.Base(path), whiteoutPrefix)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(path), base), true
+}
+
+// syncWhiteout removes the path named by the whiteout entry hdr.
+func (s *Sync) syncWhiteout(hdr *tar.Header) error {
+	path := normalizePath(hdr.Name)
+	if filepath.Base(path) == whiteoutOpaque {
+		return fmt.Errorf("opaque whiteouts aren't supported")
+	}
+
+	target, _ := whiteoutTarget(path)
+	if _, _, err := LstatOrStat(s.fs, target); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat: %s: %w", target, err)
+	}
+
+	if err := s.touchDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	if err := s.undoSaveTree(target); err != nil {
+		return err
+	}
+
+	upd, err := s.removeAll(target)
+	if err != nil {
+		return err
+	}
+
+	s.upd = upd
+	return nil
+}
@@ -0,0 +1,441 @@
+package aferosync
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	_ Lchowner   = (*BasePathFs)(nil)
+	_ Linker     = (*BasePathFs)(nil)
+	_ AllPathser = (*BasePathFs)(nil)
+	_ TarOuter   = (*BasePathFs)(nil)
+	_ Xattrer    = (*BasePathFs)(nil)
+
+	_ Lchowner   = (*ReadOnlyFs)(nil)
+	_ Linker     = (*ReadOnlyFs)(nil)
+	_ AllPathser = (*ReadOnlyFs)(nil)
+	_ TarOuter   = (*ReadOnlyFs)(nil)
+	_ Xattrer    = (*ReadOnlyFs)(nil)
+
+	_ afero.Symlinker = (*CacheOnReadFs)(nil)
+	_ Lchowner        = (*CacheOnReadFs)(nil)
+	_ Linker          = (*CacheOnReadFs)(nil)
+	_ AllPathser      = (*CacheOnReadFs)(nil)
+	_ TarOuter        = (*CacheOnReadFs)(nil)
+	_ Xattrer         = (*CacheOnReadFs)(nil)
+)
+
+// BasePathFs is an afero.BasePathFs that also forwards the aferosync optional interfaces of its
+// source, translating paths. Operations the source doesn't implement fail with
+// errors.ErrUnsupported.
+type BasePathFs struct {
+	*afero.BasePathFs
+	source afero.Fs
+	path   string
+}
+
+// NewBasePathFs restricts source to the directory path like afero.NewBasePathFs.
+func NewBasePathFs(source afero.Fs, path string) *BasePathFs {
+	return &BasePathFs{
+		BasePathFs: afero.NewBasePathFs(source, path).(*afero.BasePathFs),
+		source:     source,
+		path:       path,
+	}
+}
+
+func (b *BasePathFs) Lchown(name string, uid, gid int) error {
+	lchowner, ok := b.source.(Lchowner)
+	if !ok {
+		return &fs.PathError{Op: "lchown", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	path, err := b.RealPath(name)
+	if err != nil {
+		return &fs.PathError{Op: "lchown", Path: name, Err: err}
+	}
+
+	return lchowner.Lchown(path, uid, gid)
+}
+
+func (b *BasePathFs) Link(oldname, newname string) error {
+	linker, ok := b.source.(Linker)
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+
+	oldPath, err := b.RealPath(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	newPath, err := b.RealPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	return linker.Link(oldPath, newPath)
+}
+
+// SymlinkIfPossible stores oldname verbatim. afero.BasePathFs would prefix it with the base path.
+func (b *BasePathFs) SymlinkIfPossible(oldname, newname string) error {
+	linker, ok := b.source.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+
+	newPath, err := b.RealPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	return linker.SymlinkIfPossible(oldname, newPath)
+}
+
+// AllPaths returns the paths below the base path relative to it. The source's AllPaths is used if
+// implemented, even though it lists paths outside the base path too.
+func (b *BasePathFs) AllPaths() ([]string, error) {
+	allPathser, ok := b.source.(AllPathser)
+	if !ok {
+		return walkPaths(b)
+	}
+
+	paths, err := allPathser.AllPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	base := normalizePath(b.path)
+
+	var ret []string
+	for _, p := range paths {
+		p = normalizePath(p)
+
+		switch {
+		case base == ".":
+			ret = append(ret, p)
+		case p == base:
+			ret = append(ret, ".")
+		case strings.HasPrefix(p, base+"/"):
+			ret = append(ret, p[len(base)+1:])
+		}
+	}
+
+	return ret, nil
+}
+
+func (b *BasePathFs) TarOut(dir string, w io.Writer) error {
+	tarOuter, ok := b.source.(TarOuter)
+	if !ok {
+		return tarOut(b, dir, w, tarOptions{})
+	}
+
+	path, err := b.RealPath(dir)
+	if err != nil {
+		return &fs.PathError{Op: "tarout", Path: dir, Err: err}
+	}
+
+	return tarOuter.TarOut(path, w)
+}
+
+// xattrer returns the source's Xattrer and the real path of name.
+func (b *BasePathFs) xattrer(op, name string) (Xattrer, string, error) {
+	xattrer, ok := b.source.(Xattrer)
+	if !ok {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errors.ErrUnsupported}
+	}
+
+	path, err := b.RealPath(name)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return xattrer, path, nil
+}
+
+func (b *BasePathFs) Listxattr(name string) ([]string, error) {
+	xattrer, path, err := b.xattrer("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Listxattr(path)
+}
+
+func (b *BasePathFs) Getxattr(name, attr string) ([]byte, error) {
+	xattrer, path, err := b.xattrer("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Getxattr(path, attr)
+}
+
+func (b *BasePathFs) Setxattr(name, attr string, value []byte) error {
+	xattrer, path, err := b.xattrer("setxattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Setxattr(path, attr, value)
+}
+
+func (b *BasePathFs) Removexattr(name, attr string) error {
+	xattrer, path, err := b.xattrer("removexattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Removexattr(path, attr)
+}
+
+func (b *BasePathFs) Llistxattr(name string) ([]string, error) {
+	xattrer, path, err := b.xattrer("llistxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Llistxattr(path)
+}
+
+func (b *BasePathFs) Lgetxattr(name, attr string) ([]byte, error) {
+	xattrer, path, err := b.xattrer("lgetxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Lgetxattr(path, attr)
+}
+
+func (b *BasePathFs) Lsetxattr(name, attr string, value []byte) error {
+	xattrer, path, err := b.xattrer("lsetxattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Lsetxattr(path, attr, value)
+}
+
+func (b *BasePathFs) Lremovexattr(name, attr string) error {
+	xattrer, path, err := b.xattrer("lremovexattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Lremovexattr(path, attr)
+}
+
+// ReadOnlyFs is an afero.ReadOnlyFs that also forwards the read-only aferosync optional interfaces
+// of its source. Changes fail with syscall.EPERM like in afero.ReadOnlyFs.
+type ReadOnlyFs struct {
+	*afero.ReadOnlyFs
+	source afero.Fs
+}
+
+// NewReadOnlyFs makes source read-only like afero.NewReadOnlyFs.
+func NewReadOnlyFs(source afero.Fs) *ReadOnlyFs {
+	return &ReadOnlyFs{
+		ReadOnlyFs: afero.NewReadOnlyFs(source).(*afero.ReadOnlyFs),
+		source:     source,
+	}
+}
+
+func (r *ReadOnlyFs) Lchown(name string, uid, gid int) error {
+	return syscall.EPERM
+}
+
+func (r *ReadOnlyFs) Link(oldname, newname string) error {
+	return syscall.EPERM
+}
+
+func (r *ReadOnlyFs) AllPaths() ([]string, error) {
+	return AllPaths(r.source)
+}
+
+func (r *ReadOnlyFs) TarOut(dir string, w io.Writer) error {
+	return TarOut(r.source, dir, w)
+}
+
+func (r *ReadOnlyFs) Listxattr(name string) ([]string, error) {
+	xattrer, ok := r.source.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "listxattr", Path: name, Err: errors.ErrUnsupported}
+	}
+	return xattrer.Listxattr(name)
+}
+
+func (r *ReadOnlyFs) Getxattr(name, attr string) ([]byte, error) {
+	xattrer, ok := r.source.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: errors.ErrUnsupported}
+	}
+	return xattrer.Getxattr(name, attr)
+}
+
+func (r *ReadOnlyFs) Llistxattr(name string) ([]string, error) {
+	xattrer, ok := r.source.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "llistxattr", Path: name, Err: errors.ErrUnsupported}
+	}
+	return xattrer.Llistxattr(name)
+}
+
+func (r *ReadOnlyFs) Lgetxattr(name, attr string) ([]byte, error) {
+	xattrer, ok := r.source.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: "lgetxattr", Path: name, Err: errors.ErrUnsupported}
+	}
+	return xattrer.Lgetxattr(name, attr)
+}
+
+func (r *ReadOnlyFs) Setxattr(name, attr string, value []byte) error {
+	return syscall.EPERM
+}
+
+func (r *ReadOnlyFs) Removexattr(name, attr string) error {
+	return syscall.EPERM
+}
+
+func (r *ReadOnlyFs) Lsetxattr(name, attr string, value []byte) error {
+	return syscall.EPERM
+}
+
+func (r *ReadOnlyFs) Lremovexattr(name, attr string) error {
+	return syscall.EPERM
+}
+
+// CacheOnReadFs is an afero.CacheOnReadFs that also forwards the aferosync optional interfaces
+// of its base. Metadata is always read from base, whose FileInfo the cache layer wouldn't
+// preserve, and symlinks, hard links, ownership of symlinks and xattrs are only changed in base.
+type CacheOnReadFs struct {
+	*afero.CacheOnReadFs
+	base afero.Fs
+}
+
+// NewCacheOnReadFs caches files read from base in layer like afero.NewCacheOnReadFs.
+func NewCacheOnReadFs(base afero.Fs, layer afero.Fs, cacheTime time.Duration) *CacheOnReadFs {
+	return &CacheOnReadFs{
+		CacheOnReadFs: afero.NewCacheOnReadFs(base, layer, cacheTime).(*afero.CacheOnReadFs),
+		base:          base,
+	}
+}
+
+func (c *CacheOnReadFs) Stat(name string) (os.FileInfo, error) {
+	return c.base.Stat(name)
+}
+
+func (c *CacheOnReadFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	return LstatOrStat(c.base, name)
+}
+
+func (c *CacheOnReadFs) SymlinkIfPossible(oldname, newname string) error {
+	linker, ok := c.base.(afero.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrNoSymlink}
+	}
+	return linker.SymlinkIfPossible(oldname, newname)
+}
+
+func (c *CacheOnReadFs) ReadlinkIfPossible(name string) (string, error) {
+	reader, ok := c.base.(afero.LinkReader)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: afero.ErrNoReadlink}
+	}
+	return reader.ReadlinkIfPossible(name)
+}
+
+func (c *CacheOnReadFs) Lchown(name string, uid, gid int) error {
+	lchowner, ok := c.base.(Lchowner)
+	if !ok {
+		return &fs.PathError{Op: "lchown", Path: name, Err: errors.ErrUnsupported}
+	}
+	return lchowner.Lchown(name, uid, gid)
+}
+
+func (c *CacheOnReadFs) Link(oldname, newname string) error {
+	linker, ok := c.base.(Linker)
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+	return linker.Link(oldname, newname)
+}
+
+func (c *CacheOnReadFs) AllPaths() ([]string, error) {
+	return AllPaths(c.base)
+}
+
+func (c *CacheOnReadFs) TarOut(dir string, w io.Writer) error {
+	return TarOut(c.base, dir, w)
+}
+
+// xattrer returns the base's Xattrer.
+func (c *CacheOnReadFs) xattrer(op, name string) (Xattrer, error) {
+	xattrer, ok := c.base.(Xattrer)
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errors.ErrUnsupported}
+	}
+	return xattrer, nil
+}
+
+func (c *CacheOnReadFs) Listxattr(name string) ([]string, error) {
+	xattrer, err := c.xattrer("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Listxattr(name)
+}
+
+func (c *CacheOnReadFs) Getxattr(name, attr string) ([]byte, error) {
+	xattrer, err := c.xattrer("getxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Getxattr(name, attr)
+}
+
+func (c *CacheOnReadFs) Setxattr(name, attr string, value []byte) error {
+	xattrer, err := c.xattrer("setxattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Setxattr(name, attr, value)
+}
+
+func (c *CacheOnReadFs) Removexattr(name, attr string) error {
+	xattrer, err := c.xattrer("removexattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Removexattr(name, attr)
+}
+
+func (c *CacheOnReadFs) Llistxattr(name string) ([]string, error) {
+	xattrer, err := c.xattrer("llistxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Llistxattr(name)
+}
+
+func (c *CacheOnReadFs) Lgetxattr(name, attr string) ([]byte, error) {
+	xattrer, err := c.xattrer("lgetxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return xattrer.Lgetxattr(name, attr)
+}
+
+func (c *CacheOnReadFs) Lsetxattr(name, attr string, value []byte) error {
+	xattrer, err := c.xattrer("lsetxattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Lsetxattr(name, attr, value)
+}
+
+func (c *CacheOnReadFs) Lremovexattr(name, attr string) error {
+	xattrer, err := c.xattrer("lremovexattr", name)
+	if err != nil {
+		return err
+	}
+	return xattrer.Lremovexattr(name, attr)
+}
@@ -0,0 +1,106 @@
+package aferosync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/gaboose/aferosync"
+	"github.com/gaboose/aferosync/aferosynctest"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testWrappers(t *testing.T, afs afero.Fs, opts ...aferosync.Option) {
+	// build tar
+	tarBytes, err := aferosynctest.NewTar([]struct {
+		Header tar.Header
+		Body   string
+	}{{
+		Header: tar.Header{
+			Name:     "./dir/",
+			Typeflag: tar.TypeDir,
+			Mode:     int64(fs.ModePerm),
+			ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}, {
+		Header: tar.Header{
+			Name:    "./dir/test.txt",
+			Mode:    int64(fs.ModePerm),
+			ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		Body: "some text",
+	}, {
+		Header: tar.Header{
+			Name:     "./dir/sh",
+			Typeflag: tar.TypeSymlink,
+			Linkname: "test.txt",
+			Mode:     int64(fs.ModePerm),
+			ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}, {
+		Header: tar.Header{
+			Name:     "./dir/link",
+			Typeflag: tar.TypeLink,
+			Linkname: "./dir/test.txt",
+			Mode:     int64(fs.ModePerm),
+			ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}})
+	require.Nil(t, err)
+
+	t.Run("Wrappers/BasePathFs", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// build disk
+		err = afs.Mkdir("sub", fs.ModePerm)
+		require.Nil(t, err)
+		err = afero.WriteFile(afs, "outside.txt", []byte("some text"), fs.ModePerm)
+		require.Nil(t, err)
+
+		// sync
+		sub := aferosync.NewBasePathFs(afs, "sub")
+		updates, err := aferosync.New(sub, tar.NewReader(bytes.NewBuffer(tarBytes)), opts...).Run()
+		require.Nil(t, err)
+
+		// assert
+		assert.Len(t, updates, 4)
+		aferosynctest.AssertEqualTars(t, tarBytes, sub)
+
+		_, err = afs.Stat("outside.txt")
+		assert.Nil(t, err)
+		_, err = afs.Stat("sub/dir/test.txt")
+		assert.Nil(t, err)
+		target, err := afs.(afero.LinkReader).ReadlinkIfPossible("sub/dir/sh")
+		assert.Nil(t, err)
+		assert.Equal(t, "test.txt", target)
+
+		// resync
+		updates, err = aferosync.New(sub, tar.NewReader(bytes.NewBuffer(tarBytes)), opts...).Run()
+		require.Nil(t, err)
+		assert.Empty(t, updates)
+	})
+
+	t.Run("Wrappers/CacheOnReadFs", func(t *testing.T) {
+		err := aferosynctest.Clear(afs)
+		require.Nil(t, err)
+
+		// sync
+		cached := aferosync.NewCacheOnReadFs(afs, afero.NewMemMapFs(), 0)
+		_, err = aferosync.New(cached, tar.NewReader(bytes.NewBuffer(tarBytes)), opts...).Run()
+		require.Nil(t, err)
+
+		// assert
+		aferosynctest.AssertEqualTars(t, tarBytes, afs)
+		aferosynctest.AssertEqualTars(t, tarBytes, cached)
+
+		// resync
+		updates, err := aferosync.New(cached, tar.NewReader(bytes.NewBuffer(tarBytes)), opts...).Run()
+		require.Nil(t, err)
+		assert.Empty(t, updates)
+	})
+}
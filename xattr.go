@@ -0,0 +1,98 @@
+package aferosync
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const paxSchilyXattr = "SCHILY.xattr."
+
+// tarXattrs returns the extended attributes stored in hdr's SCHILY.xattr PAX records.
+func tarXattrs(hdr *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, paxSchilyXattr); ok {
+			xattrs[name] = v
+		}
+	}
+	return xattrs
+}
+
+// fsXattrs returns the extended attributes of path without following symlinks if nofollow is set.
+func fsXattrs(xattrer Xattrer, path string, nofollow bool) (map[string]string, error) {
+	list, get := xattrer.Listxattr, xattrer.Getxattr
+	if nofollow {
+		list, get = xattrer.Llistxattr, xattrer.Lgetxattr
+	}
+
+	names, err := list(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs: %s: %w", path, err)
+	}
+
+	xattrs := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := get(path, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get xattr: %s: %s: %w", path, name, err)
+		}
+		xattrs[name] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+// syncXattrs sets extended attributes of path so that they match want. If prune is set, attributes
+// missing from want are removed. The before func, if not nil, is called once before the first change.
+// It returns the sorted names of the attributes it changed.
+func syncXattrs(xattrer Xattrer, path string, nofollow bool, want map[string]string, prune bool, before func() error) ([]string, error) {
+	set, remove := xattrer.Setxattr, xattrer.Removexattr
+	if nofollow {
+		set, remove = xattrer.Lsetxattr, xattrer.Lremovexattr
+	}
+
+	have, err := fsXattrs(xattrer, path, nofollow)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for name, value := range want {
+		if cur, ok := have[name]; ok && cur == value {
+			continue
+		}
+
+		if len(changed) == 0 && before != nil {
+			if err := before(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := set(path, name, []byte(value)); err != nil {
+			return nil, fmt.Errorf("failed to set xattr: %s: %s: %w", path, name, err)
+		}
+		changed = append(changed, name)
+	}
+
+	for name := range have {
+		if _, ok := want[name]; ok || !prune {
+			continue
+		}
+
+		if len(changed) == 0 && before != nil {
+			if err := before(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := remove(path, name); err != nil {
+			return nil, fmt.Errorf("failed to remove xattr: %s: %s: %w", path, name, err)
+		}
+		changed = append(changed, name)
+	}
+
+	sort.Strings(changed)
+	return changed, nil
+}